@@ -21,6 +21,7 @@ import (
 	di "go.uber.org/dig"
 	daemon "github.com/coreos/go-systemd/daemon"
 
+	"git.backbone/corpix/gpgfs/pkg/audit"
 	"git.backbone/corpix/gpgfs/pkg/bus"
 	"git.backbone/corpix/gpgfs/pkg/config"
 	"git.backbone/corpix/gpgfs/pkg/crypto"
@@ -195,16 +196,14 @@ var (
 			Usage:   "Mount GPG FUSE",
 			Flags: []cli.Flag{
 				&cli.StringFlag{
-					Name:     "source",
-					Aliases:  []string{"s"},
-					Usage:    "source directory with .gpg tree",
-					Required: true,
+					Name:    "source",
+					Aliases: []string{"s"},
+					Usage:   "source directory with .gpg tree (mounted in addition to mounts from configuration)",
 				},
 				&cli.StringFlag{
-					Name:     "target",
-					Aliases:  []string{"t"},
-					Usage:    "target directory to mount filesystem with decrypted files",
-					Required: true,
+					Name:    "target",
+					Aliases: []string{"t"},
+					Usage:   "target directory to mount filesystem with decrypted files",
 				},
 			},
 			Action: MountAction,
@@ -338,6 +337,38 @@ func Before(ctx *cli.Context) error {
 		return err
 	}
 
+	err = c.Provide(func(
+		c *config.Config,
+		l log.Logger,
+		done doneCh,
+		running *sync.WaitGroup,
+	) (*audit.Audit, error) {
+		if !c.Audit.Enable {
+			return nil, nil
+		}
+
+		a, err := audit.New(*c.Audit)
+		if err != nil {
+			return nil, err
+		}
+
+		running.Add(1)
+		go func() {
+			defer running.Done()
+
+			<-done
+			err := a.Close()
+			if err != nil {
+				l.Error().Err(err).Msg("failed to close audit log")
+			}
+		}()
+
+		return a, nil
+	})
+	if err != nil {
+		return err
+	}
+
 	//
 
 	err = c.Provide(func() *sync.WaitGroup { return &sync.WaitGroup{} })
@@ -618,18 +649,18 @@ func MessageEncryptAction(ctx *cli.Context) error {
 		if err != nil {
 			return err
 		}
-		buf, err := enclave.Open()
+		keyring, err := fuse.NewKeyring(enclave)
 		if err != nil {
 			return err
 		}
-		defer buf.Destroy()
+		defer keyring.Wipe()
 
 		msg, err := ioutil.ReadAll(input)
 		if err != nil {
 			return err
 		}
 
-		encBuf, err := fuse.Encrypt(buf, fuse.NewPlainMessage(msg))
+		encBuf, err := keyring.Encrypt(fuse.NewPlainMessage(msg))
 		if err != nil {
 			return err
 		}
@@ -692,18 +723,18 @@ func MessageDecryptAction(ctx *cli.Context) error {
 		if err != nil {
 			return err
 		}
-		buf, err := enclave.Open()
+		keyring, err := fuse.NewKeyring(enclave)
 		if err != nil {
 			return err
 		}
-		defer buf.Destroy()
+		defer keyring.Wipe()
 
 		encBuf, err := ioutil.ReadAll(input)
 		if err != nil {
 			return err
 		}
 
-		plainMessage, err := fuse.Decrypt(buf, encBuf)
+		plainMessage, err := keyring.Decrypt(encBuf)
 		if err != nil {
 			return err
 		}
@@ -716,33 +747,82 @@ func MessageDecryptAction(ctx *cli.Context) error {
 
 //
 
+// newFuse loads the mount key into the keyring and creates filesystem for the mount.
+func newFuse(m fuse.MountConfig, l log.Logger, a *audit.Audit) (*fuse.Fuse, error) {
+	buf, err := os.ReadFile(m.Key.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	enclave, err := fuse.NewKey(
+		m.Key.Format,
+		fuse.DefaultKeyUID,
+		fuse.KeyTypePrivate,
+		buf,
+	)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := fuse.NewKeyring(enclave)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fuse.New(
+		m.Config, l, a,
+		keyring,
+		m.Source,
+		m.Target,
+	)
+	if err != nil {
+		keyring.Wipe()
+		return nil, err
+	}
+
+	return f, nil
+}
+
 func MountAction(ctx *cli.Context) error {
 	err := c.Provide(func(
 		c *config.Config,
 		l log.Logger,
+		a *audit.Audit,
 		r *telemetry.Registry,
-	) (*fuse.Fuse, error) {
-		buf, err := os.ReadFile(c.Fuse.Key.Path)
-		if err != nil {
-			return nil, err
+	) ([]*fuse.Fuse, error) {
+		mounts := c.Mounts
+		if ctx.IsSet("source") || ctx.IsSet("target") {
+			if !ctx.IsSet("source") || !ctx.IsSet("target") {
+				return nil, errors.New("both --source and --target should be specified")
+			}
+			mounts = append([]*fuse.MountConfig{{
+				Config: *c.Fuse,
+				Source: ctx.String("source"),
+				Target: ctx.String("target"),
+			}}, mounts...)
+		}
+		if len(mounts) == 0 {
+			return nil, errors.New("nothing to mount, specify --source and --target or mounts in configuration")
+		}
+
+		fs := make([]*fuse.Fuse, len(mounts))
+		for n, m := range mounts {
+			f, err := newFuse(
+				*m,
+				l.With().Str("target", m.Target).Logger(),
+				a,
+			)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to create mount for %q", m.Target)
+			}
+			fs[n] = f
 		}
 
-		enclave, err := fuse.NewKey(
-			c.Fuse.Key.Format,
-			fuse.DefaultKeyUID,
-			fuse.KeyTypePrivate,
-			buf,
-		)
+		err := r.Register(fuse.NewExpiringCollector(fs))
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrap(err, "failed to register filesystem telemetry")
 		}
 
-		return fuse.New(
-			*c.Fuse, l,
-			enclave,
-			ctx.String("source"),
-			ctx.String("target"),
-		)
+		return fs, nil
 	})
 	if err != nil {
 		return err
@@ -751,29 +831,59 @@ func MountAction(ctx *cli.Context) error {
 	err = c.Provide(func(
 		c *config.Config,
 		l log.Logger,
-		f *fuse.Fuse,
+		fs []*fuse.Fuse,
 		ctx *cli.Context,
 		done doneCh,
 		running *sync.WaitGroup,
-	) (*fuse.Server, error) {
-		s, err := f.Mount()
-		if err != nil {
-			return nil, err
+	) ([]*fuse.Server, error) {
+		watchCtx, cancelWatch := context.WithCancel(context.Background())
+
+		servers := make([]*fuse.Server, 0, len(fs))
+		unmount := func() {
+			cancelWatch()
+			for n, s := range servers {
+				l.Info().Str("target", fs[n].Target()).Msg("unmounting")
+				err := s.Unmount()
+				if err != nil {
+					l.Error().
+						Err(err).
+						Str("target", fs[n].Target()).
+						Msg("failed to unmount fuse")
+				}
+			}
+			for _, f := range fs {
+				f.Wipe()
+			}
 		}
-		err = f.Preload(context.Background())
-		if err != nil {
-			return nil, err
+
+		for _, f := range fs {
+			s, err := f.Mount()
+			if err != nil {
+				unmount()
+				return nil, err
+			}
+			servers = append(servers, s)
+
+			err = f.Preload(context.Background())
+			if err != nil {
+				unmount()
+				return nil, err
+			}
+
+			err = f.Watch(watchCtx)
+			if err != nil {
+				l.Warn().
+					Err(err).
+					Str("target", f.Target()).
+					Msg("source tree changes will not be reloaded")
+			}
 		}
 
 		go func() {
 			defer running.Done()
 
 			<-done
-			l.Info().Msg("unmounting")
-			err := s.Unmount()
-			if err != nil {
-				l.Error().Err(err).Msg("failed to unmount fuse")
-			}
+			unmount()
 		}()
 
 		//
@@ -790,7 +900,7 @@ func MountAction(ctx *cli.Context) error {
 
 		running.Add(1)
 
-		return s, nil
+		return servers, nil
 	})
 	if err != nil {
 		return err
@@ -811,7 +921,7 @@ func MountAction(ctx *cli.Context) error {
 		cfg *config.Config,
 		l log.Logger,
 		t *telemetry.Server,
-		s *fuse.Server,
+		s []*fuse.Server,
 		running *sync.WaitGroup,
 		done doneCh,
 		errc chan error,
@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+const Subsystem = "audit"
+
+type (
+	Op = string
+
+	// Record represents a single access to the mounted file.
+	Record struct {
+		Time    time.Time `json:"time"`
+		Op      Op        `json:"op"`
+		Path    string    `json:"path"`
+		Source  string    `json:"source"`
+		Offset  int64     `json:"offset,omitempty"`
+		Size    int       `json:"size,omitempty"`
+		Denied  bool      `json:"denied,omitempty"`
+		Uid     uint32    `json:"uid"`
+		Gid     uint32    `json:"gid"`
+		Pid     uint32    `json:"pid"`
+		Exe     string    `json:"exe"`
+		Cmdline []string  `json:"cmdline"`
+	}
+
+	// Audit writes records as JSON lines into the file.
+	Audit struct {
+		mu   sync.Mutex
+		file *os.File
+		enc  *json.Encoder
+	}
+)
+
+const (
+	OpOpen     Op = "open"
+	OpRead     Op = "read"
+	OpConfirm  Op = "confirm"
+	OpTruncate Op = "truncate"
+	OpUnlink   Op = "unlink"
+	OpRename   Op = "rename"
+	OpCreate   Op = "create"
+	OpMkdir    Op = "mkdir"
+	OpRmdir    Op = "rmdir"
+)
+
+// Log writes the record, it is a no-op for nil Audit (when audit is disabled).
+func (a *Audit) Log(r Record) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	err := a.enc.Encode(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to write audit record")
+	}
+
+	return nil
+}
+
+func (a *Audit) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.file.Close()
+}
+
+func New(c Config) (*Audit, error) {
+	file, err := os.OpenFile(
+		c.Path,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open audit log %q", c.Path)
+	}
+
+	return &Audit{
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
@@ -0,0 +1,42 @@
+package audit
+
+import (
+	"git.backbone/corpix/gpgfs/pkg/bus"
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+type Config struct {
+	Enable bool
+	Path   string
+}
+
+func (c *Config) Default() {
+loop:
+	for {
+		switch {
+		case c.Path == "":
+			c.Path = "audit.log"
+		default:
+			break loop
+		}
+	}
+}
+
+func (c *Config) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.Path == "" {
+		return errors.New("path should not be empty")
+	}
+
+	return nil
+}
+
+func (c *Config) Update(cc interface{}) error {
+	bus.Config <- bus.ConfigUpdate{
+		Subsystem: Subsystem,
+		Config:    cc,
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/corpix/revip"
 
+	"git.backbone/corpix/gpgfs/pkg/audit"
 	"git.backbone/corpix/gpgfs/pkg/bus"
 	"git.backbone/corpix/gpgfs/pkg/fuse"
 	"git.backbone/corpix/gpgfs/pkg/log"
@@ -38,7 +39,11 @@ var (
 type Config struct {
 	Log       *log.Config
 	Telemetry *telemetry.Config
+	Audit     *audit.Config
 	Fuse      *fuse.Config
+	// Mounts are served by the same process in addition to
+	// the mount specified on the command line.
+	Mounts []*fuse.MountConfig
 
 	ShutdownGraceTime time.Duration
 }
@@ -51,6 +56,8 @@ loop:
 			c.Log = &log.Config{}
 		case c.Telemetry == nil:
 			c.Telemetry = &telemetry.Config{}
+		case c.Audit == nil:
+			c.Audit = &audit.Config{}
 		case c.Fuse == nil:
 			c.Fuse = &fuse.Config{}
 		case c.ShutdownGraceTime == 0:
@@ -59,6 +66,18 @@ loop:
 			break loop
 		}
 	}
+
+	// defaults are applied parent first, fuse defaults are applied here
+	// so mounts inherit the key even if it is not set in the fuse section
+	c.Fuse.Default()
+	c.Fuse.Key.Default()
+	for _, m := range c.Mounts {
+		if m != nil && m.Key == nil {
+			// mounts use the same key unless they have their own
+			key := *c.Fuse.Key
+			m.Key = &key
+		}
+	}
 }
 
 func (c *Config) Update(cc interface{}) error {
@@ -13,7 +13,10 @@ var (
 	Wrap    = errors.Wrap
 	Wrapf   = errors.Wrapf
 	Cause   = errors.Cause
+	Is      = errors.Is
 	HasType = errors.HasType
+
+	CombineErrors = errors.CombineErrors
 )
 
 func Fatal(err error) {
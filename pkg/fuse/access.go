@@ -0,0 +1,96 @@
+package fuse
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"git.backbone/corpix/gpgfs/pkg/audit"
+)
+
+// audit records access to the inode at path in the mountpoint
+// which corresponds to the source path into audit log.
+func (f *Fuse) audit(path string, source string, caller *Caller, op audit.Op, off int64, size int, denied bool) {
+	err := f.auditLog.Log(audit.Record{
+		Op:      op,
+		Path:    path,
+		Source:  source,
+		Offset:  off,
+		Size:    size,
+		Denied:  denied,
+		Uid:     caller.Uid,
+		Gid:     caller.Gid,
+		Pid:     caller.Pid,
+		Exe:     caller.Exe,
+		Cmdline: caller.Cmdline,
+	})
+	if err != nil {
+		f.log.
+			Error().
+			Err(err).
+			Str("path", source).
+			Msg("failed to write audit record")
+	}
+}
+
+// authorize checks the caller against attributes policy and validity window
+// and records access into audit log.
+func (f *Fuse) authorize(attr Attr, path string, source string, caller *Caller, op audit.Op, off int64, size int) syscall.Errno {
+	err := attr.validity(time.Now())
+	if err != nil {
+		f.audit(path, source, caller, op, off, size, true)
+		f.log.
+			Warn().
+			Err(err).
+			Str("path", source).
+			Uint32("uid", caller.Uid).
+			Uint32("gid", caller.Gid).
+			Uint32("pid", caller.Pid).
+			Str("exe", caller.Exe).
+			Msg("access denied outside of validity window")
+		return syscall.EACCES
+	}
+
+	err = attr.Policy.Check(caller)
+	if err != nil {
+		f.audit(path, source, caller, op, off, size, true)
+		f.log.
+			Warn().
+			Err(err).
+			Str("path", source).
+			Uint32("uid", caller.Uid).
+			Uint32("gid", caller.Gid).
+			Uint32("pid", caller.Pid).
+			Str("exe", caller.Exe).
+			Msg("access denied by policy")
+		return syscall.EACCES
+	}
+
+	f.audit(path, source, caller, op, off, size, false)
+
+	return fs.OK
+}
+
+// confirm runs approval command and records the result into audit log,
+// it should be called without node locks held because command
+// could block for a long time waiting for user.
+func (f *Fuse) confirm(ctx context.Context, path string, source string, caller *Caller) syscall.Errno {
+	err := Approve(ctx, *f.config.Approval, path, source, caller)
+	f.audit(path, source, caller, audit.OpConfirm, 0, 0, err != nil)
+	if err != nil {
+		f.log.
+			Warn().
+			Err(err).
+			Str("path", source).
+			Uint32("uid", caller.Uid).
+			Uint32("gid", caller.Gid).
+			Uint32("pid", caller.Pid).
+			Str("exe", caller.Exe).
+			Msg("access denied by approval command")
+		return syscall.EACCES
+	}
+
+	return fs.OK
+}
@@ -0,0 +1,83 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+// ApprovalConfig describes a command which is run before releasing
+// a file with confirm attribute, non-zero exit code denies access.
+type ApprovalConfig struct {
+	Command []string      `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *ApprovalConfig) Default() {
+loop:
+	for {
+		switch {
+		case c.Timeout == 0:
+			c.Timeout = 30 * time.Second
+		default:
+			break loop
+		}
+	}
+}
+
+// Approve runs approval command passing path and caller details in the environment:
+// GPGFS_PATH, GPGFS_SOURCE, GPGFS_UID, GPGFS_GID, GPGFS_PID, GPGFS_EXE, GPGFS_CMDLINE.
+func Approve(ctx context.Context, c ApprovalConfig, path string, source string, caller *Caller) error {
+	if len(c.Command) == 0 {
+		return errors.New("approval command is not configured")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.Command(c.Command[0], c.Command[1:]...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// command runs in its own process group, so it could be killed
+	// with all children which may hold the output open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(
+		os.Environ(),
+		"GPGFS_PATH="+path,
+		"GPGFS_SOURCE="+source,
+		"GPGFS_UID="+strconv.FormatUint(uint64(caller.Uid), 10),
+		"GPGFS_GID="+strconv.FormatUint(uint64(caller.Gid), 10),
+		"GPGFS_PID="+strconv.FormatUint(uint64(caller.Pid), 10),
+		"GPGFS_EXE="+caller.Exe,
+		"GPGFS_CMDLINE="+strings.Join(caller.Cmdline, " "),
+	)
+
+	err := cmd.Start()
+	if err != nil {
+		return errors.Wrap(err, "failed to start approval command")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return errors.Errorf("approval command was interrupted: %s", ctx.Err())
+	}
+	if err != nil {
+		return errors.Wrapf(err, "approval command failed: %q", strings.TrimSpace(out.String()))
+	}
+
+	return nil
+}
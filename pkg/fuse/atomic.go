@@ -0,0 +1,48 @@
+package fuse
+
+import (
+	"os"
+	"path/filepath"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+// WriteFileAtomic writes buf into a temporary file next to the path
+// and renames it over the path, so readers never see partial content.
+// Mode of the existing file is preserved, perm is used for new files.
+func WriteFileAtomic(path string, buf []byte, perm os.FileMode) error {
+	info, err := os.Stat(path)
+	switch {
+	case err == nil:
+		perm = info.Mode().Perm()
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	dir, base := filepath.Split(path)
+	tmp, err := os.CreateTemp(dir, "."+base+".*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = tmp.Write(buf)
+	if err != nil {
+		return err
+	}
+	err = tmp.Chmod(perm)
+	if err != nil {
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,161 @@
+package fuse
+
+import (
+	"os"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+type (
+	// ExhaustedAction is what happens to the mounted file when its max reads are used up.
+	ExhaustedAction = string
+	// BurnAction is what happens to the source file when its max reads are used up.
+	BurnAction = string
+)
+
+const (
+	ExhaustedHide ExhaustedAction = "hide"
+	ExhaustedDeny ExhaustedAction = "deny"
+
+	BurnNone   BurnAction = ""
+	BurnRemove BurnAction = "remove"
+	BurnRename BurnAction = "rename"
+
+	// BurnedSuffix is appended to the source file renamed by BurnRename.
+	BurnedSuffix = ".burned"
+)
+
+// ErrBurned is returned for files which max reads are used up.
+var ErrBurned = errors.New("file max reads are used up")
+
+//
+
+func validateBurn(attr Attr) error {
+	if attr.MaxReads < 0 {
+		return errors.Errorf("max reads should not be negative, got %d", attr.MaxReads)
+	}
+	if attr.Structured && (attr.MaxReads > 0 || attr.Exhausted != "" || attr.Burn != BurnNone) {
+		// fields are read independently, there is no single read to count
+		return errors.New("max reads could not be used with structured secrets")
+	}
+	switch attr.Exhausted {
+	case "", ExhaustedHide, ExhaustedDeny:
+	default:
+		return errors.Errorf(
+			"unsupported exhausted action %q, expected one of: %q, %q",
+			attr.Exhausted, ExhaustedHide, ExhaustedDeny,
+		)
+	}
+	switch attr.Burn {
+	case BurnNone, BurnRemove, BurnRename:
+	default:
+		return errors.Errorf(
+			"unsupported burn action %q, expected one of: %q, %q",
+			attr.Burn, BurnRemove, BurnRename,
+		)
+	}
+	return nil
+}
+
+// exhausted reports whether max reads of the file are used up,
+// it should be called with f.mu held.
+func (f *File) exhausted() bool {
+	return f.burned || (f.attr.MaxReads > 0 && f.reads >= f.attr.MaxReads)
+}
+
+// tryBurn destroys content of the file when max reads are used up
+// and there are no open handles left, it should be called with f.mu held.
+func (f *File) tryBurn() {
+	if f.burned || f.attr.MaxReads == 0 || f.reads < f.attr.MaxReads || f.handles > 0 {
+		return
+	}
+
+	f.burned = true
+	f.content = nil
+	f.size = 0
+	f.metadata = nil
+	f.loaded = false
+	f.generation++
+
+	f.log.
+		Info().
+		Str("path", f.path).
+		Int("reads", f.reads).
+		Msg("burned file content")
+
+	// source and tree are updated without f.mu held
+	// because kernel could call back into the filesystem
+	go f.root.burn(f, f.path, f.attr)
+}
+
+// burn applies attributes burn action to the source file at path
+// and hides the burned file from the tree unless it should deny access.
+func (f *Fuse) burn(file *File, path string, attr Attr) {
+	var err error
+	switch attr.Burn {
+	case BurnRemove:
+		err = os.Remove(path)
+		if err == nil {
+			err = os.Remove(AttrPath(path))
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+	case BurnRename:
+		err = os.Rename(path, path+BurnedSuffix)
+	}
+	if err != nil {
+		f.
+			warn(path, err).
+			Msg("failed to burn source file")
+	}
+
+	f.tombstone(path)
+
+	_ = file.NotifyContent(0, 0)
+	if attr.Exhausted == ExhaustedDeny {
+		return
+	}
+
+	err = f.unload(path)
+	if err != nil {
+		f.
+			warn(path, err).
+			Msg("failed to hide burned file")
+	}
+	f.notify()
+}
+
+// tombstone records the source file at path which still exists after burn
+// so it is not mounted again with fresh reads until it changes.
+func (f *Fuse) tombstone(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.burned[path] = info
+}
+
+// tombstoned reports whether the source file at path was burned
+// and did not change since then.
+func (f *Fuse) tombstoned(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	burned, ok := f.burned[path]
+	if !ok {
+		return false
+	}
+
+	info, err := os.Stat(path)
+	if err == nil && os.SameFile(burned, info) && info.ModTime().Equal(burned.ModTime()) && info.Size() == burned.Size() {
+		return true
+	}
+	delete(f.burned, path)
+
+	return false
+}
@@ -0,0 +1,109 @@
+package fuse
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+func TestBurn(t *testing.T) {
+	samples := []struct {
+		name      string
+		attr      string
+		mounted   bool
+		source    bool
+		renamed   bool
+		lastErrno syscall.Errno
+	}{
+		{"deny", "max-reads: 1\nexhausted: deny\n", true, true, false, syscall.EACCES},
+		{"remove and hide", "max-reads: 1\nburn: remove\n", false, false, false, 0},
+		{"rename and deny", "max-reads: 1\nexhausted: deny\nburn: rename\n", true, false, true, syscall.EACCES},
+	}
+
+	for _, sample := range samples {
+		f := newTestFuse(t, Config{})
+		path := writeSecret(t, f, "msg"+EncryptedSuffix, "burn after reading")
+		writeSource(t, f, "msg"+AttrSuffix, []byte(sample.attr))
+		file := resolveNode(t, f, "msg").(*File)
+
+		content, errno := readNode(context.Background(), file)
+		if errno != fs.OK {
+			t.Fatalf("%s: failed to read msg: %s", sample.name, errno)
+		}
+		if content != "burn after reading" {
+			t.Errorf("%s: expected %q, got %q", sample.name, "burn after reading", content)
+		}
+
+		// source and tree are updated in background after the last release
+		done := eventually(func() bool {
+			_, err := os.Stat(path)
+			_, errRenamed := os.Stat(path + BurnedSuffix)
+			return (err == nil) == sample.source &&
+				(errRenamed == nil) == sample.renamed &&
+				(f.GetChild("msg") != nil) == sample.mounted
+		})
+		if !done {
+			t.Errorf(
+				"%s: expected source %t, renamed source %t and mounted file %t",
+				sample.name, sample.source, sample.renamed, sample.mounted,
+			)
+			continue
+		}
+
+		if sample.mounted {
+			_, errno = readNode(context.Background(), file)
+			if errno != sample.lastErrno {
+				t.Errorf("%s: expected %s reading burned file, got %s", sample.name, sample.lastErrno, errno)
+			}
+		}
+	}
+}
+
+func TestBurnReload(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	path := writeSecret(t, f, "msg"+EncryptedSuffix, "burn after reading")
+	writeSource(t, f, "msg"+AttrSuffix, []byte("max-reads: 1\nexhausted: deny\n"))
+	file := resolveNode(t, f, "msg").(*File)
+
+	_, errno := readNode(context.Background(), file)
+	if errno != fs.OK {
+		t.Fatalf("failed to read msg: %s", errno)
+	}
+	if !eventually(func() bool { return f.tombstoned(path) }) {
+		t.Fatal("expected burned source file to be recorded")
+	}
+
+	// unchanged source file should not be mounted with fresh reads
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.load(context.Background(), path, info.Mode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, errno = readNode(context.Background(), resolveNode(t, f, "msg"))
+	if errno != syscall.EACCES {
+		t.Errorf("expected %s reading reloaded burned file, got %s", syscall.EACCES, errno)
+	}
+
+	writeSecret(t, f, "msg"+EncryptedSuffix, "new message")
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.load(context.Background(), path, info.Mode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, errno := readNode(context.Background(), resolveNode(t, f, "msg"))
+	if errno != fs.OK {
+		t.Fatalf("failed to read changed msg: %s", errno)
+	}
+	if content != "new message" {
+		t.Errorf("expected %q, got %q", "new message", content)
+	}
+}
@@ -0,0 +1,74 @@
+package fuse
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Caller describes a process which issued the filesystem request.
+type Caller struct {
+	Uid     uint32
+	Gid     uint32
+	Groups  []uint32
+	Pid     uint32
+	Exe     string
+	Cmdline []string
+}
+
+// NewCaller resolves the caller of the request from the context,
+// executable and command line are taken from procfs (best effort,
+// process could be gone at the moment).
+func NewCaller(ctx context.Context) *Caller {
+	c := &Caller{}
+
+	fc, ok := fuse.FromContext(ctx)
+	if !ok {
+		return c
+	}
+
+	c.Uid = fc.Uid
+	c.Gid = fc.Gid
+	c.Pid = fc.Pid
+
+	proc := "/proc/" + strconv.FormatUint(uint64(c.Pid), 10)
+
+	exe, err := os.Readlink(proc + "/exe")
+	if err == nil {
+		c.Exe = exe
+	}
+	cmdline, err := os.ReadFile(proc + "/cmdline")
+	if err == nil && len(cmdline) > 0 {
+		c.Cmdline = strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	}
+	status, err := os.ReadFile(proc + "/status")
+	if err == nil {
+		c.Groups = parseGroups(status)
+	}
+
+	return c
+}
+
+// parseGroups extracts supplementary groups from /proc/<pid>/status.
+func parseGroups(status []byte) []uint32 {
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, "Groups:"))
+		groups := make([]uint32, 0, len(fields))
+		for _, field := range fields {
+			gid, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				continue
+			}
+			groups = append(groups, uint32(gid))
+		}
+		return groups
+	}
+	return nil
+}
@@ -1,6 +1,12 @@
 package fuse
 
 import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
 	"git.backbone/corpix/gpgfs/pkg/errors"
 )
 
@@ -8,6 +14,48 @@ type Config struct {
 	Key        *KeyConfig `yaml:"key"`
 	AllowOther bool       `yaml:"allow-other"`
 	Debug      bool       `yaml:"debug"`
+	// Suffixes are recognized encrypted file suffixes which are stripped
+	// from mounted names, first one is used for files created in the mountpoint.
+	Suffixes []string `yaml:"suffixes"`
+	// Lazy builds the tree from file names only,
+	// file content is decrypted on first access.
+	Lazy bool `yaml:"lazy"`
+	// CacheTTL limits how long decrypted content lives in memory,
+	// CacheIdle evicts content which was not accessed for a while,
+	// both could be overridden by attributes file.
+	CacheTTL  time.Duration `yaml:"cache-ttl"`
+	CacheIdle time.Duration `yaml:"cache-idle"`
+	// Policy is a default access policy for files
+	// without policy in attributes file.
+	Policy *Policy `yaml:"policy"`
+	// Approval is a command to confirm access to files with confirm attribute.
+	Approval *ApprovalConfig `yaml:"approval"`
+	// Passthrough exposes selected plaintext files read-only,
+	// all other plaintext files are hidden.
+	Passthrough *PassthroughConfig `yaml:"passthrough"`
+	// Signature is a policy for files without trusted signature.
+	Signature *SignatureConfig `yaml:"signature"`
+	// Recipients is a keyring (armored public keys) of other recipients
+	// of the source files, edited files are encrypted to the same recipients.
+	Recipients string `yaml:"recipients"`
+	// Structured mounts every file as a directory with a file per field,
+	// could be overridden by attributes file.
+	Structured bool `yaml:"structured"`
+	// ExpiringWithin is a period before the end of the file validity window
+	// it is reported as expiring in telemetry.
+	ExpiringWithin time.Duration `yaml:"expiring-within"`
+	// EntryTimeout, AttrTimeout and NegativeTimeout are periods the kernel
+	// caches looked up names, attributes and missing names for,
+	// zero disables caching so source tree changes are visible immediately.
+	EntryTimeout    time.Duration `yaml:"entry-timeout"`
+	AttrTimeout     time.Duration `yaml:"attr-timeout"`
+	NegativeTimeout time.Duration `yaml:"negative-timeout"`
+	// Listing is a default listing for directories
+	// without listing in directory attributes file.
+	Listing Listing `yaml:"listing"`
+	// Workers is a number of files decrypted in parallel
+	// while the tree is preloaded, defaults to a number of CPUs.
+	Workers int `yaml:"workers"`
 }
 
 func (c *Config) Default() {
@@ -16,12 +64,96 @@ loop:
 		switch {
 		case c.Key == nil:
 			c.Key = &KeyConfig{}
+		case len(c.Suffixes) == 0:
+			c.Suffixes = []string{EncryptedSuffix}
+		case c.Policy == nil:
+			c.Policy = &Policy{}
+		case c.Approval == nil:
+			c.Approval = &ApprovalConfig{}
+		case c.Passthrough == nil:
+			c.Passthrough = &PassthroughConfig{}
+		case c.Signature == nil:
+			c.Signature = &SignatureConfig{}
+		case c.ExpiringWithin == 0:
+			c.ExpiringWithin = 7 * 24 * time.Hour
+		case c.Listing == "":
+			c.Listing = ListingAll
+		case c.Workers == 0:
+			c.Workers = runtime.NumCPU()
 		default:
 			break loop
 		}
 	}
 }
 
+// reservedSuffixes are suffixes of source files with special meaning,
+// they could not be used as encrypted file suffixes.
+var reservedSuffixes = []string{AttrSuffix, TemplateSuffix, OTPSuffix, BurnedSuffix}
+
+func (c *Config) Validate() error {
+	for _, suffix := range c.Suffixes {
+		if len(suffix) < 2 || suffix[0] != '.' || strings.ContainsAny(suffix[1:], "./") {
+			return errors.Errorf(
+				"encrypted file suffix %q should be a file extension like %q",
+				suffix, EncryptedSuffix,
+			)
+		}
+		for _, reserved := range reservedSuffixes {
+			if suffix == reserved {
+				return errors.Errorf(
+					"encrypted file suffix %q is reserved, reserved suffixes are %q",
+					suffix, reservedSuffixes,
+				)
+			}
+		}
+	}
+	err := validateListing(c.Listing)
+	if err != nil {
+		return err
+	}
+	if c.Workers < 0 {
+		return errors.Errorf("workers should not be negative, got %d", c.Workers)
+	}
+	for name, timeout := range map[string]time.Duration{
+		"entry":    c.EntryTimeout,
+		"attr":     c.AttrTimeout,
+		"negative": c.NegativeTimeout,
+	} {
+		if timeout < 0 {
+			return errors.Errorf("%s timeout should not be negative, got %s", name, timeout)
+		}
+	}
+	return nil
+}
+
+//
+
+// MountConfig describes a source tree mounted into the target
+// with its own key and options.
+type MountConfig struct {
+	Config `yaml:",inline"`
+
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+}
+
+func (c *MountConfig) Default() {
+	c.Config.Default()
+
+	c.Source = expandHome(c.Source)
+	c.Target = expandHome(c.Target)
+}
+
+func (c *MountConfig) Validate() error {
+	if c.Source == "" {
+		return errors.New("mount source should not be empty")
+	}
+	if c.Target == "" {
+		return errors.New("mount target should not be empty")
+	}
+	return c.Config.Validate()
+}
+
 //
 
 type KeyConfig struct {
@@ -39,6 +171,8 @@ loop:
 			break loop
 		}
 	}
+
+	c.Path = expandHome(c.Path)
 }
 
 func (c *KeyConfig) Validate() error {
@@ -47,3 +181,17 @@ func (c *KeyConfig) Validate() error {
 	}
 	return nil
 }
+
+//
+
+// expandHome replaces leading ~ of the path with home directory of the current user.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
@@ -0,0 +1,34 @@
+package fuse
+
+import (
+	"testing"
+)
+
+func TestConfigValidateSuffixes(t *testing.T) {
+	samples := []struct {
+		suffix string
+		valid  bool
+	}{
+		{suffix: EncryptedSuffix, valid: true},
+		{suffix: ArmoredSuffix, valid: true},
+		{suffix: "gpg", valid: false},
+		{suffix: ".", valid: false},
+		{suffix: ".tar.gpg", valid: false},
+		{suffix: AttrSuffix, valid: false},
+		{suffix: TemplateSuffix, valid: false},
+		{suffix: OTPSuffix, valid: false},
+		{suffix: BurnedSuffix, valid: false},
+	}
+
+	for _, sample := range samples {
+		c := Config{Suffixes: []string{sample.suffix}}
+		c.Default()
+		err := c.Validate()
+		if sample.valid && err != nil {
+			t.Errorf("%s: expected suffix to be valid, got %s", sample.suffix, err)
+		}
+		if !sample.valid && err == nil {
+			t.Errorf("%s: expected suffix to be rejected", sample.suffix)
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"git.backbone/corpix/gpgfs/pkg/audit"
+	"git.backbone/corpix/gpgfs/pkg/log"
+)
+
+type (
+	Dir struct {
+		Inode
+
+		mu   sync.Mutex
+		root *Fuse
+		log  log.Logger
+		path string
+		attr Attr
+	}
+	DirNode interface {
+		fs.NodeGetattrer
+		fs.NodeCreater
+		fs.NodeUnlinker
+		fs.NodeRenamer
+		fs.NodeMkdirer
+		fs.NodeRmdirer
+		fs.NodeLookuper
+		fs.NodeReaddirer
+	}
+
+	// dirNode is implemented by Dir and everything embedding it (like Fuse)
+	// so rename could resolve a target directory regardless of the node type.
+	dirNode interface{ dir() *Dir }
+)
+
+// renameNoReplace is a flag argument for renameat2()
+// which refuses to replace existing target.
+const renameNoReplace = 0x1
+
+var _ = (DirNode)((*Dir)(nil))
+
+//
+
+func (d *Dir) dir() *Dir { return d }
+
+func (d *Dir) errno(msg string, err error) syscall.Errno {
+	errno := fs.ToErrno(err)
+	d.log.
+		Error().
+		Interface("errno", errno).
+		Err(err).
+		Msg(msg)
+	return errno
+}
+
+func (d *Dir) setAttr(attr Attr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.attr = attr
+}
+
+func (d *Dir) getAttr() Attr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.attr
+}
+
+// owner returns directory owner, user and group which are not set
+// in directory attributes are inherited from the parent directory.
+func (d *Dir) owner() fuse.Owner {
+	d.mu.Lock()
+	attr := d.attr
+	d.mu.Unlock()
+
+	return attr.owner(&d.Inode)
+}
+
+func (d *Dir) sourcePath() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.path
+}
+
+// relocate updates source paths of the directory and all its descendants
+// after the directory was moved in the source tree.
+func (d *Dir) relocate(path string) {
+	d.mu.Lock()
+	d.path = path
+	d.mu.Unlock()
+
+	for _, child := range d.Children() {
+		node, ok := child.Operations().(sourceNode)
+		if ok {
+			node.relocate(filepath.Join(path, filepath.Base(node.sourcePath())))
+		}
+	}
+}
+
+// entryAttr returns attributes which apply to the entry,
+// symlinks have no attributes, so default attributes apply to them.
+func (f *Fuse) entryAttr(node sourceNode) Attr {
+	switch node := node.(type) {
+	case *File:
+		node.mu.Lock()
+		defer node.mu.Unlock()
+
+		return node.attr
+	case *Structured:
+		return node.getAttr()
+	case *Template:
+		return node.getAttr()
+	}
+	return f.defaultAttr()
+}
+
+// entryAttrPath returns a path to the attributes file of the entry
+// backed by the source file at path, it is empty for symlinks.
+func (f *Fuse) entryAttrPath(node sourceNode, path string) string {
+	switch node.(type) {
+	case *File, *Structured:
+		return AttrPath(path)
+	case *Template:
+		return f.templateAttrPath(path)
+	}
+	return ""
+}
+
+// companion returns a name of the TOTP companion of the file inode name
+// if it exists in the directory.
+func (d *Dir) companion(name string, file *File) (string, bool) {
+	child := d.GetChild(name + OTPSuffix)
+	if child == nil {
+		return "", false
+	}
+	otp, ok := child.Operations().(*OTP)
+	return name + OTPSuffix, ok && otp.getFile() == file
+}
+
+func (d *Dir) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	d.mu.Lock()
+	out.Attr = *d.attr.FuseAttr
+	d.mu.Unlock()
+
+	out.Attr.Owner = d.owner()
+	out.Attr.Nlink = dirNlink(&d.Inode)
+	setSourceTimes(&out.Attr, d.sourcePath())
+
+	return fs.OK
+}
+
+func (d *Dir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, fs.FileHandle, uint32, syscall.Errno) {
+	if !d.root.editable() {
+		return nil, nil, 0, syscall.EROFS
+	}
+
+	path := filepath.Join(d.sourcePath(), name+d.root.config.Suffixes[0])
+	_, err := os.Lstat(path)
+	if err == nil {
+		return nil, nil, 0, syscall.EEXIST
+	}
+
+	attr := d.root.defaultAttr()
+	attr.Mode = mode & 07777
+
+	errno := d.root.authorize(attr, filepath.Join(d.Path(nil), name), path, NewCaller(ctx), audit.OpCreate, 0, 0)
+	if errno != fs.OK {
+		return nil, nil, 0, errno
+	}
+
+	// mode is kept in the attributes file so it survives reload of the created file,
+	// attributes file left by the removed file does not belong to the new one
+	attrPath := AttrPath(path)
+	if attr.Mode != d.root.defaultAttr().Mode {
+		err = WriteFileAtomic(attrPath, []byte(fmt.Sprintf("mode: 0%o\n", attr.Mode)), 0600)
+	} else {
+		err = os.Remove(attrPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, nil, 0, d.errno("got an error while writing file attrs", err)
+	}
+
+	file := NewFile(d.root, path, attr, nil, nil)
+	file.dirty = true
+
+	err = file.persist()
+	if err != nil {
+		_ = os.Remove(attrPath)
+		return nil, nil, 0, d.errno("got an error while creating file", err)
+	}
+
+	var attrOut fuse.AttrOut
+	file.getattr(&attrOut)
+	out.Attr = attrOut.Attr
+	out.Attr.Owner = d.owner()
+
+	inode := d.NewInode(ctx, file, d.root.stableAttr(fuse.S_IFREG, path))
+
+	d.log.
+		Info().
+		Str("inode", inode.String()).
+		Str("path", path).
+		Msg("created file")
+
+	// created file is open, so it is accounted like in File.Open
+	file.mu.Lock()
+	file.reads++
+	file.handles++
+	file.mu.Unlock()
+
+	return inode, &fileHandle{}, fuse.FOPEN_KEEP_CACHE, fs.OK
+}
+
+func (d *Dir) Unlink(ctx context.Context, name string) syscall.Errno {
+	if !d.root.editable() {
+		return syscall.EROFS
+	}
+
+	child := d.GetChild(name)
+	if child == nil {
+		return syscall.ENOENT
+	}
+	if symlink, ok := child.Operations().(*Symlink); ok {
+		path := symlink.sourcePath()
+
+		// symlinks have no attributes, default policy applies
+		errno := d.root.authorize(d.root.defaultAttr(), filepath.Join(d.Path(nil), name), path, NewCaller(ctx), audit.OpUnlink, 0, 0)
+		if errno != fs.OK {
+			return errno
+		}
+
+		err := os.Remove(path)
+		if err != nil {
+			return d.errno("got an error while removing symlink", err)
+		}
+
+		d.log.
+			Info().
+			Str("path", path).
+			Msg("removed symlink")
+
+		return fs.OK
+	}
+
+	file, ok := child.Operations().(*File)
+	if !ok {
+		// templates, passthrough files and totp companions are read-only
+		return syscall.EPERM
+	}
+
+	file.mu.Lock()
+	errno := file.authorize(NewCaller(ctx), audit.OpUnlink, 0, 0)
+	file.mu.Unlock()
+	if errno != fs.OK {
+		return errno
+	}
+
+	path := file.sourcePath()
+	err := os.Remove(path)
+	if err != nil {
+		return d.errno("got an error while removing file", err)
+	}
+	// handles which are still open should not bring the file back on flush
+	file.mu.Lock()
+	file.unlinked = true
+	file.dirty = false
+	file.mu.Unlock()
+
+	err = os.Remove(AttrPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return d.errno("got an error while removing file attrs", err)
+	}
+
+	// companion is removed without notifying the kernel
+	// which holds directory lock until unlink returns
+	if otp, ok := d.companion(name, file); ok {
+		d.RmChild(otp)
+	}
+
+	d.log.
+		Info().
+		Str("path", path).
+		Msg("removed file")
+
+	return fs.OK
+}
+
+func (d *Dir) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if !d.root.editable() {
+		return syscall.EROFS
+	}
+	if flags&fs.RENAME_EXCHANGE != 0 {
+		return syscall.ENOTSUP
+	}
+
+	child := d.GetChild(name)
+	if child == nil {
+		return syscall.ENOENT
+	}
+	parent, ok := newParent.(dirNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+	newDir := parent.dir().sourcePath()
+
+	if flags&renameNoReplace != 0 {
+		target, err := d.root.resolve(ctx, parent.dir(), newName)
+		if err != nil {
+			return d.errno("got an error while looking up rename target", err)
+		}
+		if target != nil {
+			return syscall.EEXIST
+		}
+	}
+
+	switch node := child.Operations().(type) {
+	case *PlainFile:
+		// passthrough files are exposed read-only,
+		// renamed file could also stop matching passthrough globs
+		return syscall.EROFS
+	case dirNode:
+		path := node.dir().sourcePath()
+		newPath := filepath.Join(newDir, newName)
+
+		err := os.Rename(path, newPath)
+		if err != nil {
+			return d.errno("got an error while renaming directory", err)
+		}
+
+		node.dir().relocate(newPath)
+
+		d.log.
+			Info().
+			Str("path", path).
+			Str("new-path", newPath).
+			Msg("renamed directory")
+	case sourceNode:
+		return d.renameEntry(ctx, name, node, parent.dir(), newName, flags)
+	default:
+		// totp companion follows the file it belongs to
+		return syscall.EPERM
+	}
+
+	return fs.OK
+}
+
+// renameEntry moves the source file of the entry name and its attributes file to newName
+// in the newParent directory, source files with any suffix which would be mounted
+// as newName are replaced, so they do not shadow or duplicate the renamed entry.
+func (d *Dir) renameEntry(ctx context.Context, name string, node sourceNode, newParent *Dir, newName string, flags uint32) syscall.Errno {
+	path := node.sourcePath()
+	errno := d.root.authorize(d.root.entryAttr(node), filepath.Join(d.Path(nil), name), path, NewCaller(ctx), audit.OpRename, 0, 0)
+	if errno != fs.OK {
+		return errno
+	}
+
+	// mounted name is a prefix of the source file name, suffixes are kept
+	var (
+		newDir      = newParent.sourcePath()
+		newPath     = filepath.Join(newDir, newName+strings.TrimPrefix(filepath.Base(path), name))
+		attrPath    = d.root.entryAttrPath(node, path)
+		newAttrPath = filepath.Join(newDir, newName+AttrSuffix)
+	)
+
+	// plaintext file with the same name is not mounted along with the entry,
+	// it is replaced only if it is the new path itself
+	var (
+		candidates = d.root.candidates(newDir, newName)
+		seen       = map[string]bool{path: true}
+		targets    []string
+	)
+	for _, target := range append(candidates[:len(candidates)-1:len(candidates)-1], newPath) {
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		if _, err := os.Lstat(target); err == nil {
+			targets = append(targets, target)
+		}
+	}
+	if flags&renameNoReplace != 0 {
+		// target could be hidden from the mountpoint but still exist in the source tree
+		if _, err := os.Lstat(newAttrPath); err == nil || len(targets) > 0 {
+			return syscall.EEXIST
+		}
+	}
+
+	err := os.Rename(path, newPath)
+	if err != nil {
+		return d.errno("got an error while renaming file", err)
+	}
+	for _, target := range targets {
+		if target == newPath {
+			continue
+		}
+		err = os.Remove(target)
+		if err != nil && !os.IsNotExist(err) {
+			return d.errno("got an error while removing rename target", err)
+		}
+	}
+
+	err = os.ErrNotExist
+	if attrPath != "" {
+		err = os.Rename(attrPath, newAttrPath)
+	}
+	if os.IsNotExist(err) {
+		// target could have attrs which do not belong to the moved entry
+		err = os.Remove(newAttrPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return d.errno("got an error while renaming file attrs", err)
+	}
+
+	node.relocate(newPath)
+
+	// companion of the replaced file is removed without notifying the kernel
+	// which holds directory locks until rename returns
+	if target := newParent.GetChild(newName); target != nil {
+		if file, ok := target.Operations().(*File); ok {
+			if otp, ok := newParent.companion(newName, file); ok {
+				newParent.RmChild(otp)
+			}
+		}
+	}
+	if file, ok := node.(*File); ok {
+		if otp, ok := d.companion(name, file); ok {
+			d.MvChild(otp, newParent.EmbeddedInode(), newName+OTPSuffix, true)
+		}
+	}
+
+	d.log.
+		Info().
+		Str("path", path).
+		Str("new-path", newPath).
+		Msg("renamed file")
+
+	return fs.OK
+}
+
+func (d *Dir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if !d.root.editable() {
+		return nil, syscall.EROFS
+	}
+
+	// new directory has no attributes yet, policy of the parent applies
+	path := filepath.Join(d.sourcePath(), name)
+	errno := d.root.authorize(d.getAttr(), filepath.Join(d.Path(nil), name), path, NewCaller(ctx), audit.OpMkdir, 0, 0)
+	if errno != fs.OK {
+		return nil, errno
+	}
+
+	err := os.Mkdir(path, os.FileMode(mode&07777))
+	if err != nil {
+		return nil, d.errno("got an error while creating directory", err)
+	}
+
+	inode := d.NewInode(
+		ctx,
+		NewDir(d.root, path),
+		d.root.stableAttr(fuse.S_IFDIR, path),
+	)
+
+	d.log.
+		Info().
+		Str("inode", inode.String()).
+		Str("path", path).
+		Msg("created directory")
+
+	return inode, fs.OK
+}
+
+func (d *Dir) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if !d.root.editable() {
+		return syscall.EROFS
+	}
+
+	child := d.GetChild(name)
+	if child == nil {
+		return syscall.ENOENT
+	}
+	dir, ok := child.Operations().(dirNode)
+	if !ok {
+		// structured secret is a directory only in the mountpoint,
+		// it is backed by a single source file
+		return syscall.EPERM
+	}
+
+	path := dir.dir().sourcePath()
+	errno := d.root.authorize(dir.dir().getAttr(), filepath.Join(d.Path(nil), name), path, NewCaller(ctx), audit.OpRmdir, 0, 0)
+	if errno != fs.OK {
+		return errno
+	}
+
+	// directory attributes file is not visible in the mountpoint,
+	// it is removed if it is the only entry left
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return d.errno("got an error while reading directory", err)
+	}
+	if len(entries) == 1 && entries[0].Name() == DirAttrName {
+		err = os.Remove(filepath.Join(path, DirAttrName))
+		if err != nil {
+			return d.errno("got an error while removing directory attrs", err)
+		}
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return d.errno("got an error while removing directory", err)
+	}
+
+	d.log.
+		Info().
+		Str("path", path).
+		Msg("removed directory")
+
+	return fs.OK
+}
+
+func NewDir(root *Fuse, path string) *Dir {
+	return &Dir{
+		root: root,
+		log:  root.log,
+		path: path,
+		attr: root.defaultDirAttr(),
+	}
+}
@@ -0,0 +1,383 @@
+package fuse
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestDirCreate(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	ctx := context.Background()
+
+	samples := []struct {
+		name     string
+		mode     uint32
+		writable bool
+	}{
+		{"private", 0o644, true},
+		{"default", 0o400, false},
+	}
+	for _, sample := range samples {
+		var out fuse.EntryOut
+		_, _, _, errno := f.Create(ctx, sample.name, syscall.O_WRONLY, sample.mode, &out)
+		if errno != fs.OK {
+			t.Fatalf("%s: failed to create: %s", sample.name, errno)
+		}
+
+		// created file is loaded again by watcher once it appears in the source tree
+		path := filepath.Join(f.source, sample.name+EncryptedSuffix)
+		err := f.reload(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		file := resolveNode(t, f, sample.name).(*File)
+		var attrOut fuse.AttrOut
+		file.Getattr(ctx, nil, &attrOut)
+		if attrOut.Mode != sample.mode {
+			t.Errorf("%s: expected mode %#o after reload, got %#o", sample.name, sample.mode, attrOut.Mode)
+		}
+
+		errno = writeNode(ctx, file, syscall.O_WRONLY|syscall.O_TRUNC, "content")
+		if (errno == fs.OK) != sample.writable {
+			t.Errorf("%s: expected writable %t, got %s", sample.name, sample.writable, errno)
+		}
+
+		_, err = os.Stat(AttrPath(path))
+		if sample.mode == f.defaultAttr().Mode && !os.IsNotExist(err) {
+			t.Errorf("%s: expected no attributes file for default mode, got %v", sample.name, err)
+		}
+	}
+}
+
+func TestDirCreateHandle(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	ctx := context.Background()
+
+	var out fuse.EntryOut
+	inode, fh, _, errno := f.Create(ctx, "msg", syscall.O_WRONLY, 0o600, &out)
+	if errno != fs.OK {
+		t.Fatalf("failed to create: %s", errno)
+	}
+	if fh == nil {
+		t.Fatal("expected created file to have a handle")
+	}
+
+	file := inode.Operations().(*File)
+	_, errno = file.Write(ctx, fh, []byte("new message"), 0)
+	if errno != fs.OK {
+		t.Fatalf("failed to write: %s", errno)
+	}
+	errno = file.Release(ctx, fh)
+	if errno != fs.OK {
+		t.Fatalf("failed to release: %s", errno)
+	}
+	if file.handles != 0 {
+		t.Errorf("expected no open handles after release, got %d", file.handles)
+	}
+
+	content := readSecret(t, f, filepath.Join(f.source, "msg"+EncryptedSuffix))
+	if content != "new message" {
+		t.Errorf("expected %q, got %q", "new message", content)
+	}
+}
+
+func TestDirCreateDenied(t *testing.T) {
+	f := newTestFuse(t, Config{Policy: &Policy{AllowUids: []uint32{1000}}})
+
+	var out fuse.EntryOut
+	_, _, _, errno := f.Create(callerContext(1001), "msg", syscall.O_WRONLY, 0o600, &out)
+	if errno != syscall.EACCES {
+		t.Errorf("expected %s creating file denied by policy, got %s", syscall.EACCES, errno)
+	}
+	_, err := os.Stat(filepath.Join(f.source, "msg"+EncryptedSuffix))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no source file after denied create, got %v", err)
+	}
+}
+
+func TestDirUnlink(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	ctx := context.Background()
+	path := writeSecret(t, f, "msg"+EncryptedSuffix, "old message")
+	writeSource(t, f, "msg"+AttrSuffix, []byte("mode: 0600\n"))
+
+	file := resolveNode(t, f, "msg").(*File)
+	fh, _, errno := file.Open(ctx, syscall.O_WRONLY)
+	if errno != fs.OK {
+		t.Fatalf("failed to open msg: %s", errno)
+	}
+	_, errno = file.Write(ctx, fh, []byte("unsaved"), 0)
+	if errno != fs.OK {
+		t.Fatalf("failed to write msg: %s", errno)
+	}
+
+	errno = f.Unlink(ctx, "msg")
+	if errno != fs.OK {
+		t.Fatalf("failed to unlink msg: %s", errno)
+	}
+	errno = file.Release(ctx, fh)
+	if errno != fs.OK {
+		t.Errorf("expected release of unlinked file to succeed, got %s", errno)
+	}
+
+	for _, p := range []string{path, AttrPath(path)} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("expected %q to be removed, got %v", p, err)
+		}
+	}
+}
+
+func TestDirRename(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	ctx := context.Background()
+	path := writeSecret(t, f, "msg"+EncryptedSuffix, "test message")
+	writeSource(t, f, "msg"+AttrSuffix, []byte("mode: 0600\n"))
+	writeSecret(t, f, "dir/nested"+EncryptedSuffix, "nested message")
+
+	file := resolveNode(t, f, "msg").(*File)
+	dir := resolveNode(t, f, "dir").(*Dir)
+
+	errno := f.Rename(ctx, "msg", dir, "renamed", 0)
+	if errno != fs.OK {
+		t.Fatalf("failed to rename msg: %s", errno)
+	}
+	newPath := filepath.Join(f.source, "dir", "renamed"+EncryptedSuffix)
+	for _, p := range []string{path, AttrPath(path)} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("expected %q to be moved, got %v", p, err)
+		}
+	}
+	if file.sourcePath() != newPath {
+		t.Errorf("expected file source path %q, got %q", newPath, file.sourcePath())
+	}
+	if content := readSecret(t, f, newPath); content != "test message" {
+		t.Errorf("expected %q, got %q", "test message", content)
+	}
+	if _, err := os.Stat(AttrPath(newPath)); err != nil {
+		t.Errorf("expected attributes file to follow the file: %s", err)
+	}
+
+	// go-fuse moves renamed inode to the new parent only when mounted
+	writeSecret(t, f, "taken"+EncryptedSuffix, "taken")
+	resolveNode(t, f, "dir/renamed")
+	errno = dir.Rename(ctx, "renamed", f, "taken", renameNoReplace)
+	if errno != syscall.EEXIST {
+		t.Errorf("expected %s renaming over existing file without replace, got %s", syscall.EEXIST, errno)
+	}
+
+	// directory is renamed as is, its children follow it
+	nested := resolveNode(t, f, "dir/nested").(*File)
+	errno = f.Rename(ctx, "dir", f, "moved", 0)
+	if errno != fs.OK {
+		t.Fatalf("failed to rename dir: %s", errno)
+	}
+	if expected := filepath.Join(f.source, "moved"); dir.sourcePath() != expected {
+		t.Errorf("expected directory source path %q, got %q", expected, dir.sourcePath())
+	}
+	if expected := filepath.Join(f.source, "moved", "nested"+EncryptedSuffix); nested.sourcePath() != expected {
+		t.Errorf("expected nested file source path %q, got %q", expected, nested.sourcePath())
+	}
+}
+
+func TestDirRenameReplace(t *testing.T) {
+	f := newTestFuse(t, Config{Suffixes: []string{EncryptedSuffix, ArmoredSuffix}})
+	ctx := context.Background()
+	path := writeSecret(t, f, "a"+EncryptedSuffix, "a message")
+	target := writeSecret(t, f, "b"+ArmoredSuffix, "b message")
+	writeSource(t, f, "b"+AttrSuffix, []byte("mode: 0600\n"))
+	resolveNode(t, f, "a")
+	resolveNode(t, f, "b")
+
+	errno := f.Rename(ctx, "a", f, "b", renameNoReplace)
+	if errno != syscall.EEXIST {
+		t.Errorf("expected %s renaming over file with another suffix, got %s", syscall.EEXIST, errno)
+	}
+
+	errno = f.Rename(ctx, "a", f, "b", 0)
+	if errno != fs.OK {
+		t.Fatalf("failed to rename a: %s", errno)
+	}
+	for _, p := range []string{path, target, filepath.Join(f.source, "b"+AttrSuffix)} {
+		_, err := os.Stat(p)
+		if !os.IsNotExist(err) {
+			t.Errorf("expected %q to be replaced, got %v", p, err)
+		}
+	}
+	content := readSecret(t, f, filepath.Join(f.source, "b"+EncryptedSuffix))
+	if content != "a message" {
+		t.Errorf("expected %q, got %q", "a message", content)
+	}
+}
+
+func TestDirRenameEntries(t *testing.T) {
+	f := newTestFuse(t, Config{Passthrough: &PassthroughConfig{Include: []string{"*.md"}}})
+	ctx := context.Background()
+	writeSecret(t, f, "db"+TemplateSuffix+EncryptedSuffix, "template")
+	writeSource(t, f, "db"+AttrSuffix, []byte("mode: 0440\n"))
+	writeSource(t, f, "README.md", []byte("plaintext"))
+	err := os.Symlink("target", filepath.Join(f.source, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveNode(t, f, "db")
+	resolveNode(t, f, "README.md")
+	resolveNode(t, f, "link")
+
+	samples := []struct {
+		name    string
+		newName string
+		errno   syscall.Errno
+		paths   []string
+	}{
+		{"db", "cache", fs.OK, []string{"cache" + TemplateSuffix + EncryptedSuffix, "cache" + AttrSuffix}},
+		{"link", "newlink", fs.OK, []string{"newlink"}},
+		{"README.md", "NOTES.md", syscall.EROFS, []string{"README.md"}},
+	}
+	for _, sample := range samples {
+		errno := f.Rename(ctx, sample.name, f, sample.newName, 0)
+		if errno != sample.errno {
+			t.Errorf("%s: expected %s, got %s", sample.name, sample.errno, errno)
+		}
+		for _, p := range sample.paths {
+			_, err := os.Lstat(filepath.Join(f.source, p))
+			if err != nil {
+				t.Errorf("%s: expected %q to exist, got %v", sample.name, p, err)
+			}
+		}
+	}
+}
+
+func TestDirRmdir(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	ctx := context.Background()
+	writeSource(t, f, "empty/"+DirAttrName, []byte("mode: 0700\n"))
+	writeSource(t, f, "hidden/notes.txt", []byte("plaintext"))
+	resolveNode(t, f, "empty")
+	resolveNode(t, f, "hidden")
+
+	errno := f.Rmdir(ctx, "empty")
+	if errno != fs.OK {
+		t.Errorf("expected directory with attributes file only to be removed, got %s", errno)
+	}
+	_, err := os.Stat(filepath.Join(f.source, "empty"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no source directory, got %v", err)
+	}
+
+	errno = f.Rmdir(ctx, "hidden")
+	if errno != syscall.ENOTEMPTY {
+		t.Errorf("expected %s for directory with hidden files, got %s", syscall.ENOTEMPTY, errno)
+	}
+}
+
+func TestDirSignatureRequired(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	ctx := context.Background()
+	path := writeSecret(t, f, "msg"+EncryptedSuffix, "test message")
+	writeSecret(t, f, "dir/nested"+EncryptedSuffix, "nested message")
+	resolveNode(t, f, "msg")
+	dir := resolveNode(t, f, "dir").(*Dir)
+
+	// unsigned files are mounted before policy is enforced to check changes only
+	f.config.Signature.Policy = SignaturePolicyRequire
+
+	var out fuse.EntryOut
+	_, mkdirErrno := f.Mkdir(ctx, "new", 0o700, &out)
+	samples := []struct {
+		name  string
+		errno syscall.Errno
+	}{
+		{"unlink", f.Unlink(ctx, "msg")},
+		{"rename", f.Rename(ctx, "msg", dir, "renamed", 0)},
+		{"rmdir", f.Rmdir(ctx, "dir")},
+		{"mkdir", mkdirErrno},
+	}
+
+	for _, sample := range samples {
+		if sample.errno != syscall.EROFS {
+			t.Errorf("%s: expected %s with required signature, got %s", sample.name, syscall.EROFS, sample.errno)
+		}
+	}
+	_, err := os.Stat(path)
+	if err != nil {
+		t.Errorf("expected source file to stay, got %v", err)
+	}
+	_, err = os.Stat(filepath.Join(f.source, "new"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no new directory, got %v", err)
+	}
+}
+
+func TestDirPolicy(t *testing.T) {
+	f := newTestFuse(t, Config{Policy: &Policy{AllowUids: []uint32{1000}}})
+	writeSource(t, f, "dir/"+DirAttrName, []byte("allow-uids: [1000]\n"))
+	err := os.Symlink("target", filepath.Join(f.source, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolveNode(t, f, "link")
+	dir := resolveNode(t, f, "dir").(*Dir)
+
+	var out fuse.EntryOut
+	_, mkdirErrno := dir.Mkdir(callerContext(1001), "new", 0o700, &out)
+	samples := []struct {
+		name  string
+		errno syscall.Errno
+		path  string
+	}{
+		{"unlink symlink", f.Unlink(callerContext(1001), "link"), "link"},
+		{"mkdir", mkdirErrno, "dir"},
+		{"rmdir", f.Rmdir(callerContext(1001), "dir"), "dir"},
+	}
+	for _, sample := range samples {
+		if sample.errno != syscall.EACCES {
+			t.Errorf("%s: expected %s denied by policy, got %s", sample.name, syscall.EACCES, sample.errno)
+		}
+		_, err = os.Lstat(filepath.Join(f.source, sample.path))
+		if err != nil {
+			t.Errorf("%s: expected %q to stay, got %v", sample.name, sample.path, err)
+		}
+	}
+	_, err = os.Stat(filepath.Join(f.source, "dir", "new"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no directory created against policy, got %v", err)
+	}
+
+	errno := f.Unlink(callerContext(1000), "link")
+	if errno != fs.OK {
+		t.Errorf("expected allowed caller to remove symlink, got %s", errno)
+	}
+}
+
+func TestDirReloadAttr(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	attrPath := writeSource(t, f, "dir/"+DirAttrName, []byte("mode: 0700\n"))
+	dir := resolveNode(t, f, "dir").(*Dir)
+
+	writeSource(t, f, "dir/"+DirAttrName, []byte("mode: 0750\n"))
+	err := f.reloadDirAttr(attrPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out fuse.AttrOut
+	dir.Getattr(context.Background(), nil, &out)
+	if out.Mode&07777 != 0o750 {
+		t.Errorf("expected reloaded mode 0750, got %#o", out.Mode&07777)
+	}
+
+	// kernel is notified about changed directory after f.mu is released
+	f.mu.Lock()
+	stale := f.stale
+	f.mu.Unlock()
+	if len(stale) != 1 || stale[0] != &dir.Inode {
+		t.Errorf("expected dir to be queued for notification, got %v", stale)
+	}
+}
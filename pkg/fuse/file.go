@@ -2,29 +2,78 @@ package fuse
 
 import (
 	"context"
+	"fmt"
 	"os/user"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"git.backbone/corpix/gpgfs/pkg/audit"
 	"git.backbone/corpix/gpgfs/pkg/errors"
 	"git.backbone/corpix/gpgfs/pkg/log"
 )
 
 const (
 	EncryptedSuffix = ".gpg"
+	ArmoredSuffix   = ".asc"
 	AttrSuffix      = ".yml"
+	// DirAttrName is a name of the attributes file for the directory it is in.
+	DirAttrName = ".dir" + AttrSuffix
+
+	XattrPrefix      = "user.gpgfs."
+	XattrSource      = XattrPrefix + "source"
+	XattrKeyID       = XattrPrefix + "key-id"
+	XattrSigner      = XattrPrefix + "signer"
+	XattrDecryptedAt = XattrPrefix + "decrypted-at"
+	// XattrPlaintext marks passthrough files which are exposed as they are,
+	// they are neither encrypted nor signed.
+	XattrPlaintext = XattrPrefix + "plaintext"
+
+	// MaxFileSize limits size of the content written into the mounted file
+	// because content is kept in locked memory.
+	MaxFileSize = 4 << 20
 )
 
+// ErrFileTooLarge is returned when content would grow past MaxFileSize.
+var ErrFileTooLarge = errors.Errorf("file size should not exceed %d bytes", MaxFileSize)
+
 type (
 	Attr struct {
 		*FuseAttr
+		Policy `yaml:",inline"`
 
 		User  string
 		Group string
+
+		CacheTTL  time.Duration `yaml:"cache-ttl"`
+		CacheIdle time.Duration `yaml:"cache-idle"`
+
+		// Confirm requires approval command to succeed before file is opened.
+		Confirm bool `yaml:"confirm"`
+		// Structured mounts the file as a directory with a file per field.
+		Structured bool `yaml:"structured"`
+
+		// MaxReads limits how many times the file could be opened,
+		// Exhausted and Burn control what happens when reads are used up.
+		MaxReads  int             `yaml:"max-reads"`
+		Exhausted ExhaustedAction `yaml:"exhausted"`
+		Burn      BurnAction      `yaml:"burn"`
+
+		// ValidAfter and ValidBefore limit the time window file is accessible in,
+		// file is hidden from directory listing outside of the window.
+		ValidAfter  time.Time `yaml:"valid-after"`
+		ValidBefore time.Time `yaml:"valid-before"`
+
+		// Listing restricts what listing of the directory reveals,
+		// it is used by directory attributes only.
+		Listing Listing `yaml:"listing"`
 	}
 	FuseAttr = fuse.Attr
 	FSAttr   = fs.StableAttr
@@ -34,9 +83,38 @@ type (
 		Inode
 
 		mu      sync.Mutex
+		root    *Fuse
 		log     log.Logger
+		path    string
 		attr    Attr
 		content *Enclave
+		loaded  bool
+		dirty   bool
+		// unlinked is true when the source file was removed through the mountpoint,
+		// content of the handles which are still open is never persisted
+		unlinked bool
+
+		// size is a size of the plaintext content, it is recorded when content
+		// is decrypted or changed and kept after eviction, sized is false
+		// until content of the lazy file was decrypted at least once
+		size  int64
+		sized bool
+
+		// metadata describes the last decryption of the content,
+		// it is nil until content is decrypted
+		metadata *Metadata
+
+		// generation is incremented each time content is (re)loaded or evicted
+		// so eviction timers scheduled for previous content become no-op
+		generation uint64
+		accessed   time.Time
+
+		// reads is a number of times the content was opened,
+		// content is burned when it reaches attr.MaxReads
+		// and the last handle is released
+		reads   int
+		handles int
+		burned  bool
 	}
 	FileNode interface {
 		fs.NodeOpener
@@ -45,13 +123,28 @@ type (
 		fs.NodeSetattrer
 		fs.NodeGetattrer
 		fs.NodeFlusher
+		fs.NodeFsyncer
+		fs.NodeReleaser
+		fs.NodeGetxattrer
+		fs.NodeListxattrer
 	}
+
+	// fileHandle is returned by File.Open because release is delivered
+	// only for opens with a handle, file state is kept in File.
+	fileHandle struct{}
 )
 
 var _ = (FileNode)((*File)(nil))
 
 //
 
+// AttrPath returns a path to the attributes file for the encrypted file path.
+func AttrPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + AttrSuffix
+}
+
+//
+
 func (a *Attr) Expand() error {
 	if a.User != "" {
 		u, err := user.Lookup(a.User)
@@ -80,9 +173,83 @@ func (a *Attr) Expand() error {
 		a.FuseAttr.Gid = uint32(id)
 	}
 
+	err := validateBurn(*a)
+	if err != nil {
+		return err
+	}
+	err = validateListing(a.Listing)
+	if err != nil {
+		return err
+	}
+
+	return a.Policy.Expand()
+}
+
+// UnmarshalYAML decodes attributes, mode and timestamps are decoded explicitly
+// because embedded FuseAttr pointer could not be inlined.
+func (a *Attr) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Attr
+	err := unmarshal((*plain)(a))
+	if err != nil {
+		return err
+	}
+
+	var fuseAttr struct {
+		Mode  *uint32 `yaml:"mode"`
+		Atime *uint64 `yaml:"atime"`
+		Mtime *uint64 `yaml:"mtime"`
+		Ctime *uint64 `yaml:"ctime"`
+	}
+	err = unmarshal(&fuseAttr)
+	if err != nil {
+		return err
+	}
+	if a.FuseAttr == nil {
+		a.FuseAttr = &FuseAttr{}
+	}
+	if fuseAttr.Mode != nil {
+		a.FuseAttr.Mode = *fuseAttr.Mode & 07777
+	}
+	if fuseAttr.Atime != nil {
+		a.FuseAttr.Atime = *fuseAttr.Atime
+	}
+	if fuseAttr.Mtime != nil {
+		a.FuseAttr.Mtime = *fuseAttr.Mtime
+	}
+	if fuseAttr.Ctime != nil {
+		a.FuseAttr.Ctime = *fuseAttr.Ctime
+	}
+
 	return nil
 }
 
+// owner returns owner from attributes, user and group which are not set
+// are inherited from the parent directory of the inode.
+func (a Attr) owner(inode *Inode) fuse.Owner {
+	owner := a.FuseAttr.Owner
+	if a.User != "" && a.Group != "" {
+		return owner
+	}
+
+	_, parent := inode.Parent()
+	if parent == nil {
+		return owner
+	}
+	dir, ok := parent.Operations().(dirNode)
+	if !ok {
+		return owner
+	}
+
+	parentOwner := dir.dir().owner()
+	if a.User == "" {
+		owner.Uid = parentOwner.Uid
+	}
+	if a.Group == "" {
+		owner.Gid = parentOwner.Gid
+	}
+	return owner
+}
+
 //
 
 func (f *File) errno(msg string, err error, errno syscall.Errno) syscall.Errno {
@@ -94,69 +261,610 @@ func (f *File) errno(msg string, err error, errno syscall.Errno) syscall.Errno {
 	return errno
 }
 
+// decryptErrno maps content decryption error to errno,
+// denied access, content without trusted signature
+// and burned content are not accessible.
+func decryptErrno(err error) syscall.Errno {
+	if errors.Is(err, syscall.EACCES) || errors.Is(err, ErrUntrustedSignature) || errors.Is(err, ErrBurned) {
+		return syscall.EACCES
+	}
+	return syscall.EIO
+}
+
+// writable reports whether file mode permits writes,
+// it should be called with f.mu held.
+func (f *File) writable() bool {
+	return f.attr.Mode&0222 != 0
+}
+
+// resizeErrno maps content resize error to errno.
+func resizeErrno(err error) syscall.Errno {
+	if errors.Is(err, ErrFileTooLarge) {
+		return syscall.EFBIG
+	}
+	return syscall.EIO
+}
+
+func (f *File) audit(caller *Caller, op audit.Op, off int64, size int, denied bool) {
+	f.root.audit(f.Path(nil), f.path, caller, op, off, size, denied)
+}
+
+// authorize checks the caller against file policy and records access into audit log.
+func (f *File) authorize(caller *Caller, op audit.Op, off int64, size int) syscall.Errno {
+	return f.root.authorize(f.attr, f.Path(nil), f.path, caller, op, off, size)
+}
+
+// confirm runs approval command, it should be called without f.mu held
+// because command could block for a long time waiting for user.
+func (f *File) confirm(ctx context.Context, caller *Caller) syscall.Errno {
+	return f.root.confirm(ctx, f.Path(nil), f.sourcePath(), caller)
+}
+
+func (f *File) sourcePath() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.path
+}
+
+func (f *File) relocate(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.path = path
+}
+
+// update replaces attrs and content of the file,
+// it refuses to do this if file has unsaved changes.
+// Content which is not loaded will be decrypted on first access.
+func (f *File) update(attr Attr, content *Enclave, metadata *Metadata, loaded bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.dirty {
+		return false
+	}
+
+	f.attr = attr
+	f.content = content
+	f.metadata = metadata
+	f.loaded = loaded
+	f.size = enclaveSize(content)
+	f.sized = loaded
+	f.reads = 0
+	f.burned = false
+	if loaded {
+		f.expire()
+	} else {
+		f.generation++
+	}
+
+	return true
+}
+
+func (f *File) setAttr(attr Attr) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.attr = attr
+}
+
+// decrypt loads file content from the source file if it is not loaded yet.
+func (f *File) decrypt() error {
+	if f.burned {
+		return ErrBurned
+	}
+	if f.loaded {
+		return nil
+	}
+
+	plainMessage, metadata, err := f.root.decrypt(f.path)
+	if err != nil {
+		return err
+	}
+
+	otp := HasTOTP(plainMessage.Data)
+	f.size = int64(len(plainMessage.Data))
+	f.sized = true
+	f.content = NewEnclave(plainMessage.Data)
+	f.metadata = metadata
+	f.loaded = true
+	f.expire()
+
+	f.log.
+		Debug().
+		Str("path", f.path).
+		Msg("decrypted file")
+
+	if f.root.config.Lazy {
+		// tree is updated without f.mu held, see mountLazyOTP
+		go f.root.mountLazyOTP(f, otp)
+	}
+
+	return nil
+}
+
+// expire schedules content eviction according to cache attributes,
+// it should be called with f.mu held every time content is loaded.
+func (f *File) expire() {
+	f.generation++
+	f.accessed = time.Now()
+
+	if f.attr.CacheTTL > 0 {
+		f.schedule(f.generation, f.attr.CacheTTL, false)
+	}
+	if f.attr.CacheIdle > 0 {
+		f.schedule(f.generation, f.attr.CacheIdle, true)
+	}
+}
+
+func (f *File) schedule(generation uint64, after time.Duration, idle bool) {
+	time.AfterFunc(after, func() {
+		if f.tryEvict(generation, after, idle) {
+			// decrypted content also lives in the kernel page cache,
+			// this should be done without f.mu held because kernel
+			// could call back into the filesystem
+			_ = f.NotifyContent(0, 0)
+		}
+	})
+}
+
+func (f *File) tryEvict(generation uint64, after time.Duration, idle bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if generation != f.generation {
+		return false
+	}
+	if idle {
+		left := f.attr.CacheIdle - time.Since(f.accessed)
+		if left > 0 {
+			f.schedule(generation, left, idle)
+			return false
+		}
+	}
+	if f.dirty {
+		// unsaved changes exist only in memory, retry later
+		f.schedule(generation, after, idle)
+		return false
+	}
+
+	f.evict()
+
+	return true
+}
+
+// evict drops decrypted content, it will be decrypted again on next access.
+func (f *File) evict() {
+	f.content = nil
+	f.loaded = false
+	f.generation++
+
+	f.log.
+		Debug().
+		Str("path", f.path).
+		Msg("evicted file content")
+}
+
+// open returns a content buffer which should be destroyed by the caller,
+// empty files have no enclave (memguard refuses to seal zero length data).
+func (f *File) open() (*LockedBuffer, error) {
+	err := f.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	if f.content == nil {
+		return NewBuffer(0), nil
+	}
+	return f.content.Open()
+}
+
+// resize replaces content with a copy truncated or zero padded to size
+// and writes data at offset (if any), result is sealed into a new enclave.
+// Size is checked before allocation because memguard panics when it could not lock memory.
+func (f *File) resize(size int64, data []byte, off int64) error {
+	if size < 0 || size > MaxFileSize {
+		return ErrFileTooLarge
+	}
+	if size == 0 {
+		f.content = nil
+		f.loaded = true
+		f.dirty = true
+		f.size = 0
+		f.sized = true
+		return nil
+	}
+
+	buf, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer buf.Destroy()
+
+	content := buf.Bytes()
+	if int64(len(content)) > size {
+		content = content[:size]
+	}
+
+	next := NewBuffer(int(size))
+	next.Copy(content)
+	next.CopyAt(int(off), data)
+
+	f.content = next.Seal()
+	f.dirty = true
+	f.size = size
+	f.sized = true
+
+	return nil
+}
+
+// persist encrypts current content to the recipients of the source file
+// and atomically replaces it, content is not persisted if any of the recipients is unknown.
+func (f *File) persist() error {
+	if !f.dirty {
+		return nil
+	}
+	if f.unlinked {
+		f.dirty = false
+		return nil
+	}
+
+	recipients, err := f.root.sourceRecipients(f.path)
+	if err != nil {
+		return err
+	}
+
+	buf, err := f.open()
+	if err != nil {
+		return errors.Wrap(err, "failed to open file content enclave")
+	}
+	defer buf.Destroy()
+
+	plainMessage := NewPlainMessage(buf.Bytes())
+	defer WipeBytes(plainMessage.Data)
+
+	encBuf, err := f.root.keyring.EncryptTo(plainMessage, recipients, f.root.recipients)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(f.path, ArmoredSuffix) {
+		encBuf, err = Armor(encBuf)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = WriteFileAtomic(f.path, encBuf, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %q", f.path)
+	}
+
+	f.dirty = false
+
+	f.log.
+		Info().
+		Str("path", f.path).
+		Msg("persisted file")
+
+	return nil
+}
+
 func (f *File) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	return nil, fuse.FOPEN_KEEP_CACHE, fs.OK
+	caller := NewCaller(ctx)
+
+	f.mu.Lock()
+	errno = f.authorize(caller, audit.OpOpen, 0, 0)
+	confirm := f.attr.Confirm
+	f.mu.Unlock()
+
+	if errno != fs.OK {
+		return nil, 0, errno
+	}
+	if confirm {
+		errno = f.confirm(ctx, caller)
+		if errno != fs.OK {
+			return nil, 0, errno
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.exhausted() {
+		return nil, 0, f.errno(
+			"refusing to open file with max reads used up",
+			ErrBurned, syscall.EACCES,
+		)
+	}
+	if writeFlags(flags) && !f.root.editable() {
+		return nil, 0, syscall.EROFS
+	}
+	if writeFlags(flags) && !f.writable() {
+		return nil, 0, syscall.EACCES
+	}
+
+	// lazy file reports zero size until it is decrypted and kernel
+	// would stop reading at cached size, so page cache is bypassed
+	fuseFlags = fuse.FOPEN_KEEP_CACHE
+	if !f.sized {
+		fuseFlags = fuse.FOPEN_DIRECT_IO
+	}
+
+	if flags&syscall.O_TRUNC != 0 {
+		err := f.resize(0, nil, 0)
+		if err != nil {
+			return nil, 0, f.errno(
+				"got an error while truncating file content",
+				err, syscall.EIO,
+			)
+		}
+	} else {
+		err := f.decrypt()
+		if err != nil {
+			return nil, 0, f.errno(
+				"got an error while decrypting file content",
+				err, decryptErrno(err),
+			)
+		}
+	}
+	f.accessed = time.Now()
+	f.reads++
+	f.handles++
+
+	return &fileHandle{}, fuseFlags, fs.OK
 }
 
 func (f *File) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
-	return 0, syscall.ENOSYS
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.decrypt()
+	if err != nil {
+		return 0, f.errno(
+			"got an error while decrypting file content",
+			err, decryptErrno(err),
+		)
+	}
+
+	size := off + int64(len(data))
+	if f.size > size {
+		size = f.size
+	}
+
+	err = f.resize(size, data, off)
+	if err != nil {
+		return 0, f.errno(
+			"got an error while writing file content",
+			err, resizeErrno(err),
+		)
+	}
+
+	return uint32(len(data)), fs.OK
 }
 
 func (f *File) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	buf, err := f.content.Open()
+	errno := f.authorize(NewCaller(ctx), audit.OpRead, off, len(dest))
+	if errno != fs.OK {
+		return nil, errno
+	}
+
+	buf, err := f.open()
 	if err != nil {
 		return nil, f.errno(
 			"got an error while opening file content enclave",
-			err, syscall.EIO,
+			err, decryptErrno(err),
 		)
 	}
 	// NOTE: buf resources freed by readResult.Done()
 	// so, consider all following code as "critical section" :)
 	// defer buf.Destroy()
 
-	end := off + int64(len(dest))
-	if end > int64(buf.Size()) {
-		end = int64(buf.Size())
-	}
+	f.accessed = time.Now()
 
-	return NewReadResult(buf, off, end), fs.OK
+	return newDestReadResult(buf, dest, off), fs.OK
 }
 
 func (f *File) Flush(ctx context.Context, fh fs.FileHandle) syscall.Errno {
-	return 0
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.persist()
+	if err != nil {
+		return f.errno(
+			"got an error while persisting file content",
+			err, syscall.EIO,
+		)
+	}
+
+	return fs.OK
+}
+
+func (f *File) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) syscall.Errno {
+	return f.Flush(ctx, fh)
+}
+
+func (f *File) Release(ctx context.Context, fh fs.FileHandle) syscall.Errno {
+	errno := f.Flush(ctx, fh)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.handles--
+	if f.dirty && f.handles == 0 {
+		f.discard()
+	}
+	f.tryBurn()
+
+	return errno
+}
+
+// discard drops changes which could not be persisted when the last handle is released,
+// content is decrypted from the source file again on next access, it should be called with f.mu held.
+func (f *File) discard() {
+	f.dirty = false
+	f.size = 0
+	f.sized = false
+	f.evict()
+
+	f.log.
+		Error().
+		Str("path", f.path).
+		Msg("discarded unsaved changes of file which could not be persisted")
+
+	// discarded content also lives in the kernel page cache,
+	// kernel could call back into the filesystem, see schedule
+	go func() { _ = f.NotifyContent(0, 0) }()
 }
 
 func (f *File) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
-	return syscall.ENOSYS
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	size, ok := in.GetSize()
+	if ok {
+		errno := f.authorize(NewCaller(ctx), audit.OpTruncate, int64(size), 0)
+		if errno != fs.OK {
+			return errno
+		}
+		if !f.root.editable() {
+			return syscall.EROFS
+		}
+		if !f.writable() {
+			return syscall.EACCES
+		}
+		err := f.resize(int64(size), nil, 0)
+		if err != nil {
+			return f.errno(
+				"got an error while truncating file content",
+				err, resizeErrno(err),
+			)
+		}
+	}
+
+	f.getattr(out)
+
+	return fs.OK
 }
 
 func (f *File) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	buf, err := f.content.Open()
-	if err != nil {
-		return f.errno(
-			"got an error while opening file content enclave",
-			err, syscall.EIO,
-		)
+	f.getattr(out)
+
+	return fs.OK
+}
+
+// xattrs returns extended attributes of the file,
+// decryption metadata is not available until file is decrypted.
+func (f *File) xattrs() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	xattrs := map[string]string{XattrSource: f.path}
+	if f.metadata != nil {
+		xattrs[XattrKeyID] = fmt.Sprintf("%016X", f.metadata.KeyID)
+		xattrs[XattrDecryptedAt] = f.metadata.DecryptedAt.Format(time.RFC3339)
+		if f.metadata.SignerKeyID != 0 {
+			xattrs[XattrSigner] = fmt.Sprintf("%016X", f.metadata.SignerKeyID)
+		}
+	}
+	return xattrs
+}
+
+func (f *File) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	return getxattr(f.xattrs(), attr, dest)
+}
+
+func (f *File) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	return listxattr(f.xattrs(), dest)
+}
+
+// getxattr copies value of the extended attribute into dest,
+// size of the value is returned if dest is empty.
+func getxattr(xattrs map[string]string, attr string, dest []byte) (uint32, syscall.Errno) {
+	value, ok := xattrs[attr]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) == 0 {
+		return uint32(len(value)), fs.OK
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
 	}
-	defer buf.Destroy()
 
+	return uint32(copy(dest, value)), fs.OK
+}
+
+// listxattr copies sorted zero terminated names of the extended attributes into dest,
+// size of the list is returned if dest is empty.
+func listxattr(xattrs map[string]string, dest []byte) (uint32, syscall.Errno) {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	for _, name := range names {
+		buf = append(buf, name...)
+		buf = append(buf, 0)
+	}
+	if len(dest) == 0 {
+		return uint32(len(buf)), fs.OK
+	}
+	if len(dest) < len(buf) {
+		return uint32(len(buf)), syscall.ERANGE
+	}
+
+	return uint32(copy(dest, buf)), fs.OK
+}
+
+func (f *File) getattr(out *fuse.AttrOut) {
 	out.Attr = *f.attr.FuseAttr
-	out.Attr.Size = uint64(len(buf.Bytes()))
+	out.Attr.Owner = f.attr.owner(&f.Inode)
+	out.Attr.Nlink = 1
+	setSourceTimes(&out.Attr, f.path)
+	out.Attr.Size = uint64(f.size)
+}
 
-	return fs.OK
+// enclaveSize returns size of the content in the enclave,
+// empty content has no enclave.
+func enclaveSize(content *Enclave) int64 {
+	if content == nil {
+		return 0
+	}
+	return int64(content.Size())
 }
 
-func NewFile(l log.Logger, attr Attr, content *Enclave) *File {
+func NewFile(root *Fuse, path string, attr Attr, content *Enclave, metadata *Metadata) *File {
+	f := &File{
+		root:     root,
+		log:      root.log,
+		path:     path,
+		attr:     attr,
+		content:  content,
+		metadata: metadata,
+		loaded:   true,
+		size:     enclaveSize(content),
+		sized:    true,
+	}
+	f.expire()
+
+	return f
+}
+
+// NewLazyFile creates a file which content is decrypted from path on first access.
+func NewLazyFile(root *Fuse, path string, attr Attr) *File {
 	return &File{
-		log:     l,
-		attr:    attr,
-		content: content,
+		root: root,
+		log:  root.log,
+		path: path,
+		attr: attr,
 	}
 }
 
@@ -184,3 +892,22 @@ func NewReadResult(lb *LockedBuffer, offset int64, end int64) ReadResult {
 		end:          end,
 	}
 }
+
+// newDestReadResult creates read result for the dest sized chunk
+// of the buffer at offset, chunk is clamped to the buffer size.
+func newDestReadResult(lb *LockedBuffer, dest []byte, offset int64) ReadResult {
+	end := offset + int64(len(dest))
+	if end > int64(lb.Size()) {
+		end = int64(lb.Size())
+	}
+	if offset > end {
+		offset = end
+	}
+
+	return NewReadResult(lb, offset, end)
+}
+
+// writeFlags reports whether open flags request modification of the file.
+func writeFlags(flags uint32) bool {
+	return flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0
+}
@@ -0,0 +1,199 @@
+package fuse
+
+import (
+	"context"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// writeNode replaces content of the node as if it was opened with flags
+// and written by the caller, content is persisted on release.
+func writeNode(ctx context.Context, node fs.InodeEmbedder, flags uint32, content string) syscall.Errno {
+	file := node.(*File)
+
+	fh, _, errno := file.Open(ctx, flags)
+	if errno != fs.OK {
+		return errno
+	}
+	_, errno = file.Write(ctx, fh, []byte(content), 0)
+	if errno != fs.OK {
+		file.Release(ctx, fh)
+		return errno
+	}
+	return file.Release(ctx, fh)
+}
+
+func TestFileWriteThrough(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	var (
+		other = testOtherKeyring(t)
+		ids   = []uint64{testKeyID(t, f.keyring), testKeyID(t, other)}
+	)
+	f.recipients = testRecipients(t, other)
+
+	encBuf, err := f.keyring.EncryptTo(NewPlainMessage([]byte("old message")), ids, f.recipients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeSource(t, f, "msg"+EncryptedSuffix, encBuf)
+	writeSource(t, f, "msg"+AttrSuffix, []byte("mode: 0600\n"))
+
+	errno := writeNode(context.Background(), resolveNode(t, f, "msg"), syscall.O_WRONLY|syscall.O_TRUNC, "new message")
+	if errno != fs.OK {
+		t.Fatalf("failed to write msg: %s", errno)
+	}
+	if content := readSecret(t, f, path); content != "new message" {
+		t.Errorf("expected source to contain %q, got %q", "new message", content)
+	}
+
+	recipients, err := MessageRecipients(readSource(t, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(recipients, func(i, j int) bool { return recipients[i] < recipients[j] })
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(recipients) != 2 || recipients[0] != ids[0] || recipients[1] != ids[1] {
+		t.Errorf("expected edited file to keep recipients %016X, got %016X", ids, recipients)
+	}
+
+	content, errno := readNode(context.Background(), resolveNode(t, f, "msg"))
+	if errno != fs.OK {
+		t.Fatalf("failed to read msg: %s", errno)
+	}
+	if content != "new message" {
+		t.Errorf("expected %q, got %q", "new message", content)
+	}
+}
+
+func TestFileWriteDenied(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	path := writeSecret(t, f, "msg"+EncryptedSuffix, "old message")
+
+	errno := writeNode(context.Background(), resolveNode(t, f, "msg"), syscall.O_WRONLY, "new message")
+	if errno != syscall.EACCES {
+		t.Errorf("expected %s writing read-only file, got %s", syscall.EACCES, errno)
+	}
+	if content := readSecret(t, f, path); content != "old message" {
+		t.Errorf("expected source to keep %q, got %q", "old message", content)
+	}
+}
+
+func TestLazyFile(t *testing.T) {
+	policy := Policy{AllowUids: []uint32{1000}}
+	f := newTestFuse(t, Config{Lazy: true, Policy: &policy})
+	writeSecret(t, f, "msg"+EncryptedSuffix, "test message")
+
+	var out fuse.EntryOut
+	inode, errno := f.Lookup(callerContext(0), "msg", &out)
+	if errno != fs.OK {
+		t.Fatalf("failed to look up msg: %s", errno)
+	}
+	file := inode.Operations().(*File)
+	if file.loaded || file.sized || out.Size != 0 {
+		t.Fatalf("expected lookup not to decrypt the file, got size %d", out.Size)
+	}
+
+	_, errno = readNode(callerContext(0), file)
+	if errno != syscall.EACCES {
+		t.Errorf("expected %s reading by denied caller, got %s", syscall.EACCES, errno)
+	}
+	if file.loaded || file.sized {
+		t.Error("expected denied read not to decrypt the file")
+	}
+
+	fh, flags, errno := file.Open(callerContext(1000), syscall.O_RDONLY)
+	if errno != fs.OK {
+		t.Fatalf("failed to open msg: %s", errno)
+	}
+	if flags&fuse.FOPEN_DIRECT_IO == 0 {
+		t.Error("expected file of unknown size to be opened with direct io")
+	}
+	file.Release(callerContext(1000), fh)
+
+	var attrOut fuse.AttrOut
+	file.Getattr(callerContext(0), nil, &attrOut)
+	if attrOut.Size != uint64(len("test message")) {
+		t.Errorf("expected size %d after decryption, got %d", len("test message"), attrOut.Size)
+	}
+
+	fh, flags, errno = file.Open(callerContext(1000), syscall.O_RDONLY)
+	if errno != fs.OK {
+		t.Fatalf("failed to open msg: %s", errno)
+	}
+	if flags&fuse.FOPEN_DIRECT_IO != 0 || flags&fuse.FOPEN_KEEP_CACHE == 0 {
+		t.Errorf("expected file of known size to be opened with page cache, got flags %#x", flags)
+	}
+	file.Release(callerContext(1000), fh)
+}
+
+func TestFilePersistFailure(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	other := testOtherKeyring(t)
+	ids := []uint64{testKeyID(t, f.keyring), testKeyID(t, other)}
+
+	// other recipient is not known to the mount, so edits could not be encrypted to it
+	encBuf, err := f.keyring.EncryptTo(NewPlainMessage([]byte("old message")), ids, testRecipients(t, other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeSource(t, f, "msg"+EncryptedSuffix, encBuf)
+	writeSource(t, f, "msg"+AttrSuffix, []byte("mode: 0600\n"))
+
+	file := resolveNode(t, f, "msg").(*File)
+	errno := writeNode(context.Background(), file, syscall.O_WRONLY|syscall.O_TRUNC, "new message")
+	if errno != syscall.EIO {
+		t.Errorf("expected %s persisting file with unknown recipient, got %s", syscall.EIO, errno)
+	}
+	if file.dirty {
+		t.Error("expected unsaved changes to be discarded on the last release")
+	}
+
+	content, errno := readNode(context.Background(), file)
+	if errno != fs.OK {
+		t.Fatalf("failed to read msg: %s", errno)
+	}
+	if content != "old message" {
+		t.Errorf("expected content to be decrypted from the source again, got %q", content)
+	}
+
+	err = f.reload(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.GetChild("msg") != &file.Inode {
+		t.Error("expected source reload to update the file")
+	}
+}
+
+func TestFileSignatureRequired(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	ctx := context.Background()
+	writeSecret(t, f, "msg"+EncryptedSuffix, "old message")
+	writeSource(t, f, "msg"+AttrSuffix, []byte("mode: 0600\n"))
+	file := resolveNode(t, f, "msg").(*File)
+
+	// unsigned file is mounted before policy is enforced to check writes only
+	f.config.Signature.Policy = SignaturePolicyRequire
+
+	errno := writeNode(ctx, file, syscall.O_WRONLY, "new message")
+	if errno != syscall.EROFS {
+		t.Errorf("expected %s writing with required signature, got %s", syscall.EROFS, errno)
+	}
+
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	errno = file.Setattr(ctx, nil, in, &fuse.AttrOut{})
+	if errno != syscall.EROFS {
+		t.Errorf("expected %s truncating with required signature, got %s", syscall.EROFS, errno)
+	}
+
+	var out fuse.EntryOut
+	_, _, _, errno = f.Create(ctx, "new", syscall.O_WRONLY, 0o600, &out)
+	if errno != syscall.EROFS {
+		t.Errorf("expected %s creating with required signature, got %s", syscall.EROFS, errno)
+	}
+}
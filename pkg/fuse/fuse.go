@@ -6,24 +6,52 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/go-yaml/yaml"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"git.backbone/corpix/gpgfs/pkg/audit"
 	"git.backbone/corpix/gpgfs/pkg/errors"
 	"git.backbone/corpix/gpgfs/pkg/log"
 )
 
 type (
 	Fuse struct {
-		fs.Inode
-
-		log    log.Logger
-		key    *Enclave
-		config Config
-		source string
-		target string
+		Dir
+
+		mu         sync.Mutex
+		log        log.Logger
+		auditLog   *audit.Audit
+		keyring    *Keyring
+		signers    Signers
+		recipients Recipients
+		config     Config
+		source     string
+		target     string
+
+		// generation is a last generation of inodes stable attributes
+		generation uint64
+		// burned are source files which max reads were used up
+		// while they were left in place, see tombstone
+		burned map[string]os.FileInfo
+
+		// windowsCache are validity windows of the source tree secrets
+		// reported by telemetry, see windows
+		windowsMu     sync.Mutex
+		windowsCache  []Attr
+		windowsLoaded bool
+
+		// forgotten are entries removed from the tree and stale are inodes
+		// which content changed, the kernel was not notified about them yet, see notify
+		forgotten []forgottenEntry
+		stale     []*Inode
+	}
+	// forgottenEntry is a name removed from the parent inode.
+	forgottenEntry struct {
+		parent *Inode
+		name   string
 	}
 	Server     = fuse.Server
 	ReadResult = fuse.ReadResult
@@ -35,7 +63,7 @@ var _ = (Node)((*Fuse)(nil))
 
 //
 
-func (f *Fuse) warn(path string, d iofs.DirEntry, err error) *log.Event {
+func (f *Fuse) warn(path string, err error) *log.Event {
 	e := f.log.
 		Warn().
 		Str("path", path)
@@ -46,181 +74,550 @@ func (f *Fuse) warn(path string, d iofs.DirEntry, err error) *log.Event {
 }
 
 func (f *Fuse) OnAdd(ctx context.Context) {
-	// does nothing, whole secrets store is preloaded in f.Preload
-	// because this func can not return errors
+	// does nothing, secrets store is preloaded in f.Preload
+	// or resolved on lookup because this func can not return errors
 }
 
-func (f *Fuse) Preload(ctx context.Context) error {
-	keyBuf, err := f.key.Open()
-	if err != nil {
-		panic(errors.Wrap(err, "failed to obtain locked buffer from enclave"))
+// suffix returns recognized encrypted file suffix of the path.
+func (f *Fuse) suffix(path string) (string, bool) {
+	for _, suffix := range f.config.Suffixes {
+		if strings.HasSuffix(path, suffix) {
+			return suffix, true
+		}
 	}
-	defer keyBuf.Destroy()
+	return "", false
+}
+
+// trimSuffix strips recognized encrypted file suffix from the path.
+func (f *Fuse) trimSuffix(path string) string {
+	suffix, _ := f.suffix(path)
+	return strings.TrimSuffix(path, suffix)
+}
 
-	return filepath.WalkDir(
+// mountName strips encrypted file and template suffixes from the path.
+func (f *Fuse) mountName(path string) string {
+	return strings.TrimSuffix(f.trimSuffix(path), TemplateSuffix)
+}
+
+// inodePath returns a path of the inode in the mountpoint
+// which corresponds to the path in the source tree.
+func (f *Fuse) inodePath(path string) (string, error) {
+	inodePath, err := filepath.Rel(
 		f.source,
-		func(path string, d iofs.DirEntry, err error) error {
-			if err != nil {
-				f.
-					warn(path, d, err).
-					Msg("skipping file because of error")
-				return nil
-			}
+		f.mountName(path),
+	)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Clean(inodePath), nil
+}
+
+// lookup walks the inode tree and returns inode for the inodePath
+// with its parent, inode is nil if it does not exist.
+func (f *Fuse) lookup(inodePath string) (*Inode, *Inode) {
+	var (
+		inode       *Inode
+		inodeParent = &f.Inode
+	)
+
+	dir, base := filepath.Split(inodePath)
+	for _, component := range strings.Split(dir, string(filepath.Separator)) {
+		if len(component) == 0 {
+			continue
+		}
+
+		inodeParent = inodeParent.GetChild(component)
+		if inodeParent == nil {
+			return nil, nil
+		}
+	}
+	inode = inodeParent.GetChild(base)
+
+	return inodeParent, inode
+}
+
+// mkdir creates all missing directory components of the inode path
+// and returns the innermost directory inode.
+func (f *Fuse) mkdir(ctx context.Context, inodePath string) *Inode {
+	var (
+		inode       *Inode
+		inodeParent = &f.Inode
+		dirPath     = f.source
+	)
 
-			var (
-				inode       *Inode
-				inodePath   = path
-				inodeParent = &f.Inode
+	for _, component := range strings.Split(inodePath, string(filepath.Separator)) {
+		if len(component) == 0 || component == "." {
+			continue
+		}
+
+		dirPath = filepath.Join(dirPath, component)
+		inode = inodeParent.GetChild(component)
+		if inode == nil {
+			dir := NewDir(f, dirPath)
+			dir.setAttr(f.loadDirAttr(dirPath))
+
+			inode = inodeParent.NewInode(
+				ctx,
+				dir,
+				f.stableAttr(fuse.S_IFDIR, dirPath),
 			)
+			f.log.
+				Info().
+				Str("inode", inode.String()).
+				Str("inode-path", inodePath).
+				Str("component", component).
+				Msg("mounting directory component")
+			inodeParent.AddChild(component, inode, true)
+		}
+		inodeParent = inode
+	}
 
-			//
+	return inodeParent
+}
 
-			if d.IsDir() {
-				return nil
-			}
-			if !d.Type().IsRegular() {
-				f.
-					warn(path, d, err).
-					Msg("skipping unsupported file type")
-				return nil
-			}
-			if !strings.HasSuffix(path, EncryptedSuffix) {
-				f.
-					warn(path, d, err).
-					Msgf("skipping file without required suffix %q", EncryptedSuffix)
-				return nil
-			}
+// defaultAttr returns attributes for files without attributes file.
+func (f *Fuse) defaultAttr() Attr {
+	return Attr{
+		FuseAttr:   &FuseAttr{Mode: 0400},
+		Policy:     *f.config.Policy,
+		CacheTTL:   f.config.CacheTTL,
+		CacheIdle:  f.config.CacheIdle,
+		Structured: f.config.Structured,
+	}
+}
+
+// defaultDirAttr returns attributes for directories without attributes file,
+// zero mode is replaced with default directory mode on getattr.
+func (f *Fuse) defaultDirAttr() Attr {
+	return Attr{FuseAttr: &FuseAttr{}}
+}
 
-			//
+// loadAttr loads attributes from attrPath on top of the attr defaults.
+func (f *Fuse) loadAttr(attrPath string, attr Attr) (Attr, error) {
+	_, err := os.Stat(attrPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return attr, err
+		}
+		return attr, nil
+	}
 
-			encBuf, err := os.ReadFile(path)
-			if err != nil {
+	attrBuf, err := os.ReadFile(attrPath)
+	if err != nil {
+		return attr, errors.Wrapf(
+			err, "failed to load attrs from %q",
+			attrPath,
+		)
+	}
+	err = yaml.Unmarshal(attrBuf, &attr)
+	if err != nil {
+		return attr, errors.Wrapf(
+			err, "failed to parse attrs from %q",
+			attrPath,
+		)
+	}
+
+	err = attr.Expand()
+	if err != nil {
+		return attr, errors.Wrap(err, "faield to expand fuse node attributes")
+	}
+
+	f.log.
+		Debug().
+		Str("attr-path", attrPath).
+		Interface("attr", attr).
+		Msg("loaded attr")
+
+	return attr, nil
+}
+
+// decrypt reads and decrypts the source file at path,
+// content without trusted signature is wiped and ErrUntrustedSignature is returned.
+func (f *Fuse) decrypt(path string) (*PlainMessage, *Metadata, error) {
+	encBuf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plainMessage, metadata, err := f.keyring.DecryptMessage(encBuf, f.signers)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to decrypt %q", path)
+	}
+	err = f.verify(path, metadata)
+	if err != nil {
+		WipeBytes(plainMessage.Data)
+		return nil, nil, errors.Wrapf(err, "refusing to expose %q", path)
+	}
+
+	return plainMessage, metadata, nil
+}
+
+// skip logs the reason why the source file at path is not mounted,
+// files hidden by signature policy are removed from the tree.
+func (f *Fuse) skip(path string, err error) error {
+	if errors.Is(err, ErrUntrustedSignature) {
+		f.
+			warn(path, err).
+			Msg("hiding file because of signature policy")
+		return f.unload(path)
+	}
+
+	f.
+		warn(path, err).
+		Msg("skipping file because of error")
+	return nil
+}
+
+// load decrypts the source file at path and mounts it, creating
+// intermediate directories, existing file inode content is replaced,
+// content decrypted ahead of time by walk is passed as d (nil otherwise).
+// Kernel is notified about replaced content by notify.
+func (f *Fuse) load(ctx context.Context, path string, mode iofs.FileMode, d *decrypted) error {
+	f.invalidateWindows()
+
+	if mode&iofs.ModeSymlink != 0 {
+		return f.loadSymlink(ctx, path)
+	}
+	if !mode.IsRegular() {
+		f.
+			warn(path, nil).
+			Msg("skipping unsupported file type")
+		return nil
+	}
+	if strings.HasSuffix(f.trimSuffix(path), TemplateSuffix) {
+		return f.loadTemplate(ctx, path)
+	}
+	if _, ok := f.suffix(path); !ok {
+		if f.passthrough(path) {
+			return f.loadPlain(ctx, path)
+		}
+		f.
+			warn(path, nil).
+			Msgf("skipping file without any of required suffixes %q", f.config.Suffixes)
+		return nil
+	}
+
+	//
+
+	inodePath, err := f.inodePath(path)
+	if err != nil {
+		f.
+			warn(path, err).
+			Msg("skipping file because of error")
+		return nil
+	}
+
+	attrPath := AttrPath(path)
+	attr, err := f.loadAttr(attrPath, f.defaultAttr())
+	if err != nil {
+		return err
+	}
+	if attr.Structured {
+		return f.loadStructured(ctx, path, attr, d)
+	}
+
+	burned := f.tombstoned(path)
+	if burned && attr.Exhausted != ExhaustedDeny {
+		f.log.
+			Debug().
+			Str("path", path).
+			Msg("skipping burned file")
+		return nil
+	}
+
+	var (
+		content  *Enclave
+		metadata *Metadata
+		otp      bool
+	)
+	if !f.config.Lazy && !burned {
+		if d == nil {
+			d = f.decryptContent(path)
+		}
+		if d.err != nil {
+			return f.skip(path, d.err)
+		}
+		content, metadata, otp = d.content, d.metadata, d.otp
+	}
+
+	//
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir, base := filepath.Split(inodePath)
+	inodeParent := f.mkdir(ctx, dir)
+
+	inode := inodeParent.GetChild(base)
+	if inode != nil {
+		file, ok := inode.Operations().(*File)
+		if ok {
+			if file.sourcePath() != path {
 				f.
-					warn(path, d, err).
-					Msg("skipping file because of error")
+					warn(path, nil).
+					Str("shadowed-by", file.sourcePath()).
+					Msg("skipping file which is shadowed by file with another suffix")
 				return nil
 			}
-
-			plainMessage, err := Decrypt(keyBuf, encBuf)
-			if err != nil {
-				f.
-					warn(path, d, err).
-					Msg("skipping file because of error")
+			if burned {
+				// burned file keeps denying access until source file changes
 				return nil
 			}
-
-			//
-
-			inodePath = strings.TrimSuffix(inodePath, EncryptedSuffix)
-			inodePath, err = filepath.Rel(f.source, inodePath)
-			if err != nil {
+			if !file.update(attr, content, metadata, !f.config.Lazy) {
 				f.
-					warn(path, d, err).
-					Msg("skipping file because of error")
+					warn(path, nil).
+					Msg("skipping reload of file with unsaved changes")
 				return nil
 			}
-
-			dir, base := filepath.Split(filepath.Clean(inodePath))
-			for _, component := range strings.Split(dir, string(filepath.Separator)) {
-				if len(component) == 0 {
-					continue
-				}
-
-				inode = inodeParent.GetChild(component)
-				if inode == nil {
-					inode = inodeParent.NewPersistentInode(
-						ctx,
-						&Inode{},
-						FSAttr{Mode: fuse.S_IFDIR},
-					)
-					f.log.
-						Info().
-						Str("inode", inode.String()).
-						Str("dir", dir).
-						Str("base", base).
-						Str("path", path).
-						Str("inode-path", inodePath).
-						Str("component", component).
-						Msg("mounting directory component")
-					inodeParent.AddChild(component, inode, true)
-				}
-				inodeParent = inode
-			}
-
-			//
-
-			attr := Attr{FuseAttr: &FuseAttr{Mode: 0400}}
-			attrPath := strings.TrimSuffix(path, EncryptedSuffix) + AttrSuffix
-			_, err = os.Stat(attrPath)
-			if err == nil {
-				attrBuf, err := os.ReadFile(attrPath)
-				if err != nil {
-					return errors.Wrapf(
-						err, "failed to load attrs from %q",
-						attrPath,
-					)
-				}
-				err = yaml.Unmarshal(attrBuf, &attr)
-				if err != nil {
-					return errors.Wrapf(
-						err, "failed to parse attrs from %q",
-						attrPath,
-					)
-				}
-
-				err = attr.Expand()
-				if err != nil {
-					return errors.Wrap(err, "faield to expand fuse node attributes")
-				}
-
-				//
-
-				f.log.
-					Debug().
-					Str("dir", dir).
-					Str("base", base).
-					Str("path", path).
-					Str("inode-path", inodePath).
-					Str("attr-path", attrPath).
-					Interface("attr", attr).
-					Msg("loaded attr")
-			} else {
-				if !os.IsNotExist(err) {
-					return err
-				}
+			f.invalidate(inode)
+			if !f.config.Lazy {
+				f.mountOTP(ctx, inodeParent, base, file, otp)
 			}
 
-			//
-
-			inode = inodeParent.NewPersistentInode(
-				ctx,
-				NewFile(
-					f.log,
-					attr,
-					NewEnclave(plainMessage.Data),
-				),
-				FSAttr{},
-			)
-
 			f.log.
 				Info().
 				Str("inode", inode.String()).
-				Str("dir", dir).
-				Str("base", base).
 				Str("path", path).
 				Str("inode-path", inodePath).
-				Msg("mounting file")
-			inodeParent.AddChild(base, inode, false)
+				Msg("reloaded file")
+			return nil
+		}
+		inodeParent.RmChild(base)
+	}
+
+	var file *File
+	if f.config.Lazy {
+		file = NewLazyFile(f, path, attr)
+	} else {
+		file = NewFile(f, path, attr, content, metadata)
+	}
+	file.burned = burned
+	if attr.MaxReads > 0 {
+		// reads counter lives in the file, it should survive kernel forgetting the inode
+		inode = inodeParent.NewPersistentInode(ctx, file, f.stableAttr(fuse.S_IFREG, path))
+	} else {
+		inode = inodeParent.NewInode(ctx, file, f.stableAttr(fuse.S_IFREG, path))
+	}
+
+	f.log.
+		Info().
+		Str("inode", inode.String()).
+		Str("dir", dir).
+		Str("base", base).
+		Str("path", path).
+		Str("inode-path", inodePath).
+		Msg("mounting file")
+	inodeParent.AddChild(base, inode, false)
+	f.mountOTP(ctx, inodeParent, base, file, otp)
+
+	return nil
+}
+
+// reloadAttr loads attributes from attrPath into the corresponding file inode,
+// structured secrets are mounted again because their layout depends on attributes.
+func (f *Fuse) reloadAttr(ctx context.Context, attrPath string) error {
+	f.invalidateWindows()
+
+	inodePath, err := f.inodePath(strings.TrimSuffix(attrPath, AttrSuffix))
+	if err != nil {
+		return err
+	}
+
+	attr, err := f.loadAttr(attrPath, f.defaultAttr())
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	_, inode := f.lookup(inodePath)
+	f.mu.Unlock()
 
+	if inode == nil {
+		return nil
+	}
+	// attributes file which belongs to another source file
+	// mounted under the same name is ignored
+	switch node := inode.Operations().(type) {
+	case *Structured:
+		if AttrPath(node.sourcePath()) != attrPath {
 			return nil
-		},
-	)
+		}
+		return f.reload(ctx, node.sourcePath())
+	case *File:
+		if AttrPath(node.sourcePath()) != attrPath {
+			return nil
+		}
+		if attr.Structured {
+			return f.reload(ctx, node.sourcePath())
+		}
+		node.setAttr(attr)
+		_ = inode.NotifyContent(0, 0)
+	case *Template:
+		if f.templateAttrPath(node.sourcePath()) != attrPath {
+			return nil
+		}
+		node.setAttr(attr)
+	default:
+		return nil
+	}
+
+	f.log.
+		Info().
+		Str("inode", inode.String()).
+		Str("attr-path", attrPath).
+		Str("inode-path", inodePath).
+		Msg("reloaded attr")
+
+	return nil
+}
+
+// reload loads the source file at path again.
+func (f *Fuse) reload(ctx context.Context, path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return f.load(ctx, path, info.Mode(), nil)
+}
+
+// loadDirAttr loads attributes of the source directory at path,
+// defaults are used if attributes file could not be loaded.
+func (f *Fuse) loadDirAttr(path string) Attr {
+	attrPath := filepath.Join(path, DirAttrName)
+	attr, err := f.loadAttr(attrPath, f.defaultDirAttr())
+	if err != nil {
+		f.
+			warn(attrPath, err).
+			Msg("using default directory attributes because of error")
+		return f.defaultDirAttr()
+	}
+	return attr
 }
 
+// reloadDirAttr loads directory attributes from attrPath into the corresponding directory inode.
+func (f *Fuse) reloadDirAttr(attrPath string) error {
+	path := filepath.Dir(attrPath)
+	inodePath, err := filepath.Rel(f.source, path)
+	if err != nil {
+		return err
+	}
+
+	attr := f.loadDirAttr(path)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	inode := &f.Inode
+	if inodePath != "." {
+		_, inode = f.lookup(inodePath)
+		if inode == nil {
+			return nil
+		}
+	}
+	dir, ok := inode.Operations().(dirNode)
+	if !ok {
+		return nil
+	}
+
+	dir.dir().setAttr(attr)
+	f.invalidate(inode)
+
+	f.log.
+		Info().
+		Str("inode", inode.String()).
+		Str("attr-path", attrPath).
+		Str("inode-path", inodePath).
+		Msg("reloaded directory attr")
+
+	return nil
+}
+
+// unload removes inode corresponding to the source path from the tree
+// unless it is backed by another source file.
+func (f *Fuse) unload(path string) error {
+	f.invalidateWindows()
+
+	inodePath, err := f.inodePath(path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	inodeParent, inode := f.lookup(inodePath)
+	if inode == nil {
+		return nil
+	}
+	if node, ok := inode.Operations().(sourceNode); ok && node.sourcePath() != path {
+		// inode is backed by the source file with another suffix which shadows this one
+		return nil
+	}
+
+	base := filepath.Base(inodePath)
+	inodeParent.RmChild(base)
+	f.forget(inodeParent, base)
+	if _, ok := inode.Operations().(*File); ok {
+		f.unmountOTP(inodeParent, base)
+	}
+
+	f.log.
+		Info().
+		Str("inode", inode.String()).
+		Str("path", path).
+		Str("inode-path", inodePath).
+		Msg("unmounting file")
+
+	return nil
+}
+
+// forget queues the kernel notification about the entry removed from the tree,
+// it should be called with f.mu held.
+func (f *Fuse) forget(parent *Inode, name string) {
+	f.forgotten = append(f.forgotten, forgottenEntry{parent: parent, name: name})
+}
+
+// invalidate queues the kernel notification about changed content of the inode,
+// it should be called with f.mu held.
+func (f *Fuse) invalidate(inode *Inode) {
+	f.stale = append(f.stale, inode)
+}
+
+// notify sends queued notifications about removed entries and changed content, it blocks until
+// the kernel takes the directory lock, so it should be called without f.mu held
+// and never from Lookup or Readdir which run with directory lock held by the kernel.
+// Notifications queued while resolving lookups are sent along with the next change.
+func (f *Fuse) notify() {
+	f.mu.Lock()
+	forgotten, stale := f.forgotten, f.stale
+	f.forgotten, f.stale = nil, nil
+	f.mu.Unlock()
+
+	for _, entry := range forgotten {
+		_ = entry.parent.NotifyEntry(entry.name)
+	}
+	for _, inode := range stale {
+		_ = inode.NotifyContent(0, 0)
+	}
+}
+
+// Wipe clears the mount private key, files could not be decrypted after that.
+func (f *Fuse) Wipe() { f.keyring.Wipe() }
+
+func (f *Fuse) Source() string { return f.source }
+func (f *Fuse) Target() string { return f.target }
+
 func (f *Fuse) Mount() (*Server, error) {
 	opts := &fs.Options{}
 	opts.AllowOther = f.config.AllowOther
 	opts.Debug = f.config.Debug
+	opts.EntryTimeout = &f.config.EntryTimeout
+	opts.AttrTimeout = &f.config.AttrTimeout
+	opts.NegativeTimeout = &f.config.NegativeTimeout
 
 	server, err := fs.Mount(f.target, f, opts)
 	if err != nil {
@@ -230,7 +627,7 @@ func (f *Fuse) Mount() (*Server, error) {
 	return server, nil
 }
 
-func New(c Config, l log.Logger, key *Enclave, source string, target string) (*Fuse, error) {
+func New(c Config, l log.Logger, a *audit.Audit, keyring *Keyring, source string, target string) (*Fuse, error) {
 	_, err := os.Stat(source)
 	if err != nil {
 		return nil, errors.Wrap(err, "error while stat source")
@@ -253,11 +650,44 @@ func New(c Config, l log.Logger, key *Enclave, source string, target string) (*F
 		return nil, errors.Wrap(err, "failed to get absolute path of target")
 	}
 
-	return &Fuse{
-		config: c,
-		log:    l,
-		key:    key,
-		source: absSource,
-		target: absTarget,
-	}, nil
+	err = c.Policy.Expand()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to expand default policy")
+	}
+
+	var signers Signers
+	if c.Signature.Keyring != "" {
+		signers, err = ReadSigners(c.Signature.Keyring)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var recipients Recipients
+	if c.Recipients != "" {
+		recipients, err = ReadRecipients(c.Recipients)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f := &Fuse{
+		config:     c,
+		log:        l,
+		auditLog:   a,
+		keyring:    keyring,
+		signers:    signers,
+		recipients: recipients,
+		source:     absSource,
+		target:     absTarget,
+		burned:     map[string]os.FileInfo{},
+	}
+	f.Dir = Dir{
+		root: f,
+		log:  l,
+		path: absSource,
+		attr: f.defaultDirAttr(),
+	}
+
+	return f, nil
 }
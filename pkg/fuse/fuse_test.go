@@ -0,0 +1,356 @@
+package fuse
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	pgpcrypto "github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/rs/zerolog"
+)
+
+// testServer discards kernel notifications of the filesystem which is not mounted.
+type testServer struct{}
+
+func (testServer) DeleteNotify(parent uint64, child uint64, name string) fuse.Status {
+	return fuse.OK
+}
+func (testServer) EntryNotify(parent uint64, name string) fuse.Status           { return fuse.OK }
+func (testServer) InodeNotify(node uint64, off int64, length int64) fuse.Status { return fuse.OK }
+func (testServer) InodeRetrieveCache(node uint64, offset int64, dest []byte) (int, fuse.Status) {
+	return 0, fuse.ENOSYS
+}
+func (testServer) InodeNotifyStoreCache(node uint64, offset int64, data []byte) fuse.Status {
+	return fuse.OK
+}
+
+//
+
+// testKey reads the ssh key from the test directory as an armored keyType key.
+func testKey(t *testing.T, name string, keyType KeyType) *Enclave {
+	t.Helper()
+
+	raw, err := os.ReadFile(filepath.Join("..", "..", "test", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewKey(KeyFormatSSH, DefaultKeyUID, keyType, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testKeyring(t *testing.T, name string) *Keyring {
+	t.Helper()
+
+	keyring, err := NewKeyring(testKey(t, name, KeyTypePrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(keyring.Wipe)
+	return keyring
+}
+
+// testOtherKeyring generates a keyring of another recipient,
+// ed25519 test key could not be used because it is not an encryption key.
+func testOtherKeyring(t *testing.T) *Keyring {
+	t.Helper()
+
+	key, err := pgpcrypto.GenerateKey("other", "other@localhost", "x25519", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := key.Armor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewKeyring(NewEnclave([]byte(armored)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(keyring.Wipe)
+	return keyring
+}
+
+// testKeyID returns an id of the key messages encrypted to the keyring are decrypted with.
+func testKeyID(t *testing.T, keyring *Keyring) uint64 {
+	t.Helper()
+
+	encBuf, err := keyring.Encrypt(NewPlainMessage(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := MessageRecipients(encBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids[0]
+}
+
+// newTestFuse creates a filesystem for the empty temporary source tree
+// encrypted to the rsa test key, it is bridged to go-fuse without mounting
+// so inodes could be created and operations called directly.
+func newTestFuse(t *testing.T, c Config) *Fuse {
+	t.Helper()
+
+	c.Default()
+	f, err := New(c, zerolog.Nop(), nil, testKeyring(t, "ssh-key-rsa"), t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.NewNodeFS(f, &fs.Options{ServerCallbacks: testServer{}})
+
+	return f
+}
+
+// writeSource writes content into the source tree file name.
+func writeSource(t *testing.T, f *Fuse, name string, content []byte) string {
+	t.Helper()
+
+	path := filepath.Join(f.source, name)
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, content, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeSecret encrypts content to the mount key and writes it into the source tree file name.
+func writeSecret(t *testing.T, f *Fuse, name string, content string) string {
+	t.Helper()
+
+	encBuf, err := f.keyring.Encrypt(NewPlainMessage([]byte(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeSource(t, f, name, encBuf)
+}
+
+// readSource returns content of the source file at path.
+func readSource(t *testing.T, path string) []byte {
+	t.Helper()
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// readSecret decrypts the source file at path with the mount key.
+func readSecret(t *testing.T, f *Fuse, path string) string {
+	t.Helper()
+
+	plainMessage, err := f.keyring.Decrypt(readSource(t, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plainMessage.Data)
+}
+
+// resolveNode resolves inodePath against the source tree, it fails the test if it does not exist.
+func resolveNode(t *testing.T, f *Fuse, inodePath string) fs.InodeEmbedder {
+	t.Helper()
+
+	inode, err := f.resolvePath(context.Background(), inodePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inode == nil {
+		t.Fatalf("%q does not exist", inodePath)
+	}
+	return inode.Operations()
+}
+
+// callerContext returns request context of the caller with uid.
+func callerContext(uid uint32) context.Context {
+	return fuse.NewContext(
+		context.Background(),
+		&fuse.Caller{Owner: fuse.Owner{Uid: uid, Gid: uid}},
+	)
+}
+
+// readNode opens node for reading and returns its content,
+// the handle is released before returning.
+func readNode(ctx context.Context, node fs.InodeEmbedder) (string, syscall.Errno) {
+	fh, _, errno := node.(fs.NodeOpener).Open(ctx, syscall.O_RDONLY)
+	if errno != fs.OK {
+		return "", errno
+	}
+	if releaser, ok := node.(fs.NodeReleaser); ok {
+		defer releaser.Release(ctx, fh)
+	}
+
+	var (
+		dest   = make([]byte, 4096)
+		result fuse.ReadResult
+	)
+	if reader, ok := fh.(fs.FileReader); ok {
+		result, errno = reader.Read(ctx, dest, 0)
+	} else {
+		result, errno = node.(fs.NodeReader).Read(ctx, fh, dest, 0)
+	}
+	if errno != fs.OK {
+		return "", errno
+	}
+	defer result.Done()
+
+	buf, _ := result.Bytes(dest)
+	return string(buf), fs.OK
+}
+
+// eventually reports whether cond becomes true within a few seconds,
+// it is used for tree changes which are made in background.
+func eventually(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+//
+
+func TestResolve(t *testing.T) {
+	f := newTestFuse(t, Config{Suffixes: []string{EncryptedSuffix, ArmoredSuffix}})
+	writeSecret(t, f, "dir/msg"+EncryptedSuffix, "test message")
+	writeSource(t, f, "dir/msg"+AttrSuffix, []byte("mode: 0440\n"))
+	writeSource(t, f, "dir/notes.txt", []byte("plaintext"))
+
+	file, ok := resolveNode(t, f, "dir/msg").(*File)
+	if !ok {
+		t.Fatal("expected dir/msg to be a file")
+	}
+	var out fuse.AttrOut
+	file.Getattr(context.Background(), nil, &out)
+	if out.Mode != 0o440 {
+		t.Errorf("expected mode from attributes file 0440, got %#o", out.Mode)
+	}
+
+	content, errno := readNode(context.Background(), file)
+	if errno != fs.OK {
+		t.Fatalf("failed to read dir/msg: %s", errno)
+	}
+	if content != "test message" {
+		t.Errorf("expected %q, got %q", "test message", content)
+	}
+
+	for _, name := range []string{"dir/notes.txt", "dir/msg" + AttrSuffix, "missing"} {
+		inode, err := f.resolvePath(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inode != nil {
+			t.Errorf("expected %q to be hidden", name)
+		}
+	}
+}
+
+func TestUnloadShadowed(t *testing.T) {
+	f := newTestFuse(t, Config{Suffixes: []string{EncryptedSuffix, ArmoredSuffix}})
+	path := writeSecret(t, f, "msg"+EncryptedSuffix, "binary")
+	encBuf, err := f.keyring.Encrypt(NewPlainMessage([]byte("armored")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := Armor(encBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadowed := writeSource(t, f, "msg"+ArmoredSuffix, armored)
+
+	file := resolveNode(t, f, "msg").(*File)
+	if file.sourcePath() != path {
+		t.Fatalf("expected msg to be mounted from %q, got %q", path, file.sourcePath())
+	}
+
+	err = os.Remove(shadowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.unload(shadowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.GetChild("msg") != &file.Inode {
+		t.Error("expected removal of the shadowed file to keep msg mounted")
+	}
+
+	err = f.unload(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.GetChild("msg") != nil {
+		t.Error("expected removal of the source file to unmount msg")
+	}
+}
+
+func TestLoadNotify(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	path := writeSecret(t, f, "msg"+EncryptedSuffix, "old message")
+	file := resolveNode(t, f, "msg").(*File)
+
+	writeSecret(t, f, "msg"+EncryptedSuffix, "new message")
+	err := f.reload(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// kernel is notified about replaced content after f.mu is released
+	f.mu.Lock()
+	stale := f.stale
+	f.mu.Unlock()
+	if len(stale) != 1 || stale[0] != &file.Inode {
+		t.Errorf("expected replaced content of msg to be queued for notification, got %v", stale)
+	}
+
+	f.notify()
+	if len(f.stale) != 0 {
+		t.Errorf("expected no queued notifications after notify, got %d", len(f.stale))
+	}
+}
+
+func TestExpiringReload(t *testing.T) {
+	f := newTestFuse(t, Config{ExpiringWithin: time.Hour})
+	path := writeSecret(t, f, "msg"+EncryptedSuffix, "test message")
+
+	now := time.Now()
+	if n := f.expiring(now); n != 0 {
+		t.Fatalf("expected no expiring secrets, got %d", n)
+	}
+
+	validBefore := now.Add(30 * time.Minute).Format(time.RFC3339)
+	attrPath := writeSource(t, f, "msg"+AttrSuffix, []byte("valid-before: "+validBefore+"\n"))
+	err := f.reloadAttr(context.Background(), attrPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := f.expiring(now); n != 1 {
+		t.Errorf("expected reloaded attributes to be counted as expiring, got %d", n)
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.unload(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := f.expiring(now); n != 0 {
+		t.Errorf("expected removed secret not to be counted, got %d", n)
+	}
+}
@@ -27,6 +27,20 @@ type (
 	KeyType      = string
 	KeyCtor      = func(keyUID *packet.UserId, keyType KeyType, rawKey []byte) ([]byte, error)
 	KeyCtors     = map[KeyFormat]KeyCtor
+
+	// Metadata describes how the message was decrypted.
+	Metadata struct {
+		// KeyID is an id of the (sub)key which decrypted the message.
+		KeyID uint64
+		// SignerKeyID is an id of the key which signed the message,
+		// zero if message is not signed.
+		SignerKeyID uint64
+		// Trusted is true if message is signed by one of the trusted signers,
+		// SignatureError is the result of the signature check.
+		Trusted        bool
+		SignatureError error
+		DecryptedAt    time.Time
+	}
 )
 
 const (
@@ -34,6 +48,8 @@ const (
 
 	KeyTypePrivate KeyType = "private"
 	KeyTypePublic  KeyType = "public"
+
+	ArmorHeader = "-----BEGIN PGP MESSAGE-----"
 )
 
 var (
@@ -45,6 +61,7 @@ var (
 	}
 
 	NewEnclave      = memguard.NewEnclave
+	NewBuffer       = memguard.NewBuffer
 	NewPlainMessage = pgpcrypto.NewPlainMessage
 	NewPGPMessage   = pgpcrypto.NewPGPMessage
 
@@ -195,51 +212,16 @@ func NewKey(format KeyFormat, keyUID *packet.UserId, keyType KeyType, rawKey []b
 
 //
 
-func Encrypt(keyBuf *LockedBuffer, message *PlainMessage) ([]byte, error) {
-	public, err := pgpcrypto.NewKeyFromArmored(keyBuf.String())
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse public key")
-	}
-
-	if public.IsPrivate() {
-		public, err = public.ToPublic()
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to extract public key from private key")
-		}
-	}
-
-	publicKeyRing, err := pgpcrypto.NewKeyRing(public)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create new keyring")
-	}
-
-	cipherText, err := publicKeyRing.Encrypt(message, nil)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to encrypt message")
-	}
-
-	return cipherText.Data, nil
+// IsArmored reports whether encBuf is an ASCII-armored PGP message.
+func IsArmored(encBuf []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(encBuf), []byte(ArmorHeader))
 }
 
-func Decrypt(keyBuf *LockedBuffer, encBuf []byte) (*PlainMessage, error) {
-	private, err := pgpcrypto.NewKeyFromArmored(string(keyBuf.Bytes()))
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse the private key")
-	}
-	defer private.ClearPrivateParams()
-
-	privateKeyRing, err := pgpcrypto.NewKeyRing(private)
+// Armor wraps binary PGP message into ASCII armor.
+func Armor(encBuf []byte) ([]byte, error) {
+	armored, err := NewPGPMessage(encBuf).GetArmored()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create the private key ring")
+		return nil, errors.Wrap(err, "failed to armor message")
 	}
-
-	plainMessage, err := privateKeyRing.Decrypt(
-		NewPGPMessage(encBuf),
-		nil, 0,
-	)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to decrypt message")
-	}
-
-	return plainMessage, nil
+	return []byte(armored), nil
 }
@@ -0,0 +1,236 @@
+package fuse
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgpcrypto "github.com/ProtonMail/gopenpgp/v2/crypto"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+// Keyring is a private key parsed and unlocked once and sealed in the enclave in binary form,
+// it is opened only while a message is decrypted, public key is kept parsed for encryption.
+type Keyring struct {
+	mu     sync.RWMutex
+	key    *Enclave
+	public *pgpcrypto.KeyRing
+}
+
+// ErrKeyringWiped is returned by Keyring which key was wiped.
+var ErrKeyringWiped = errors.New("keyring is wiped")
+
+//
+
+func (k *Keyring) Encrypt(message *PlainMessage) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.public == nil {
+		return nil, ErrKeyringWiped
+	}
+
+	cipherText, err := k.public.Encrypt(message, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encrypt message")
+	}
+
+	return cipherText.Data, nil
+}
+
+// EncryptTo encrypts message to the keys with recipients ids which are resolved
+// against the keyring own key and known public keys, message is encrypted
+// to the own key only if there are no recipients.
+func (k *Keyring) EncryptTo(message *PlainMessage, recipients []uint64, known Recipients) ([]byte, error) {
+	if len(recipients) == 0 {
+		return k.Encrypt(message)
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.public == nil {
+		return nil, ErrKeyringWiped
+	}
+
+	entities := openpgp.EntityList{}
+	for _, key := range k.public.GetKeys() {
+		entities = append(entities, key.GetEntity())
+	}
+	entities = append(entities, known...)
+
+	keyring, err := pgpcrypto.NewKeyRing(nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new keyring")
+	}
+	added := make(map[uint64]bool, len(recipients))
+	for _, id := range recipients {
+		keys := entities.KeysById(id)
+		if len(keys) == 0 {
+			return nil, errors.Wrapf(ErrUnknownRecipient, "key %016X is not known", id)
+		}
+		entity := keys[0].Entity
+		if added[entity.PrimaryKey.KeyId] {
+			continue
+		}
+		added[entity.PrimaryKey.KeyId] = true
+
+		key, err := pgpcrypto.NewKeyFromEntity(entity)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to use recipient key %016X", id)
+		}
+		err = keyring.AddKey(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to use recipient key %016X", id)
+		}
+	}
+
+	cipherText, err := keyring.Encrypt(message, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encrypt message")
+	}
+
+	return cipherText.Data, nil
+}
+
+func (k *Keyring) Decrypt(encBuf []byte) (*PlainMessage, error) {
+	plainMessage, _, err := k.DecryptMessage(encBuf, nil)
+	return plainMessage, err
+}
+
+// DecryptMessage decrypts binary or armored message and reports
+// which key decrypted it and which key signed it,
+// signature is checked only if signer is one of the signers.
+func (k *Keyring) DecryptMessage(encBuf []byte, signers Signers) (*PlainMessage, *Metadata, error) {
+	private, err := k.unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer private.ClearPrivateParams()
+
+	var r io.Reader = bytes.NewReader(encBuf)
+	if IsArmored(encBuf) {
+		block, err := armor.Decode(r)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to unarmor message")
+		}
+		r = block.Body
+	}
+
+	keyring := append(openpgp.EntityList{private.GetEntity()}, signers...)
+	md, err := openpgp.ReadMessage(r, keyring, nil, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decrypt message")
+	}
+	data, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		WipeBytes(data)
+		return nil, nil, errors.Wrap(err, "failed to decrypt message")
+	}
+
+	plainMessage := NewPlainMessage(data)
+	if md.LiteralData != nil {
+		plainMessage.TextType = !md.LiteralData.IsBinary
+		plainMessage.Filename = md.LiteralData.FileName
+		plainMessage.Time = md.LiteralData.Time
+	}
+
+	metadata := &Metadata{
+		SignerKeyID: md.SignedByKeyId,
+		DecryptedAt: time.Now(),
+	}
+	if md.DecryptedWith.PublicKey != nil {
+		metadata.KeyID = md.DecryptedWith.PublicKey.KeyId
+	}
+	if md.SignedBy != nil {
+		for _, signer := range signers {
+			if signer.PrimaryKey.KeyId == md.SignedBy.Entity.PrimaryKey.KeyId {
+				metadata.Trusted = true
+				metadata.SignatureError = md.SignatureError
+				break
+			}
+		}
+	}
+
+	return plainMessage, metadata, nil
+}
+
+// unlock parses the private key from the enclave,
+// parsed key parameters should be cleared by the caller.
+func (k *Keyring) unlock() (*pgpcrypto.Key, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.key == nil {
+		return nil, ErrKeyringWiped
+	}
+
+	keyBuf, err := k.key.Open()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to obtain locked buffer from enclave")
+	}
+	defer keyBuf.Destroy()
+
+	private, err := pgpcrypto.NewKeyFromReader(bytes.NewReader(keyBuf.Bytes()))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse the private key")
+	}
+	return private, nil
+}
+
+// Wipe drops the private key enclave,
+// keyring could not be used after it was wiped.
+func (k *Keyring) Wipe() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.key = nil
+	k.public = nil
+}
+
+// NewKeyring parses the armored private key from the enclave
+// and seals it unarmored, so it is not parsed from armor again.
+func NewKeyring(key *Enclave) (*Keyring, error) {
+	keyBuf, err := key.Open()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to obtain locked buffer from enclave")
+	}
+	defer keyBuf.Destroy()
+
+	private, err := pgpcrypto.NewKeyFromArmored(keyBuf.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse the private key")
+	}
+	defer private.ClearPrivateParams()
+	if !private.IsPrivate() {
+		return nil, errors.New("keyring requires a private key")
+	}
+
+	public, err := private.ToPublic()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to extract public key from private key")
+	}
+	publicKeyRing, err := pgpcrypto.NewKeyRing(public)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new keyring")
+	}
+
+	// binary key is smaller than armored one, so the buffer is never reallocated
+	var binBuf bytes.Buffer
+	binBuf.Grow(keyBuf.Size())
+	err = private.GetEntity().SerializePrivateWithoutSigning(&binBuf, nil)
+	if err != nil {
+		WipeBytes(binBuf.Bytes())
+		return nil, errors.Wrap(err, "failed to serialize the private key")
+	}
+
+	// NOTE: enclave wipes serialized key
+	return &Keyring{
+		key:    NewEnclave(binBuf.Bytes()),
+		public: publicKeyRing,
+	}, nil
+}
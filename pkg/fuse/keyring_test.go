@@ -0,0 +1,69 @@
+package fuse
+
+import (
+	"testing"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+func TestKeyringEncryptDecrypt(t *testing.T) {
+	keyrings := map[string]*Keyring{
+		"rsa":    testKeyring(t, "ssh-key-rsa"),
+		"x25519": testOtherKeyring(t),
+	}
+	for name, keyring := range keyrings {
+		encBuf, err := keyring.Encrypt(NewPlainMessage([]byte("test message")))
+		if err != nil {
+			t.Fatalf("%s: failed to encrypt: %s", name, err)
+		}
+		armored, err := Armor(encBuf)
+		if err != nil {
+			t.Fatalf("%s: failed to armor: %s", name, err)
+		}
+
+		for _, buf := range [][]byte{encBuf, armored} {
+			plainMessage, metadata, err := keyring.DecryptMessage(buf, nil)
+			if err != nil {
+				t.Fatalf("%s: failed to decrypt: %s", name, err)
+			}
+			if string(plainMessage.Data) != "test message" {
+				t.Errorf("%s: expected %q, got %q", name, "test message", plainMessage.Data)
+			}
+			if metadata.KeyID != testKeyID(t, keyring) {
+				t.Errorf("%s: expected message decrypted with %016X, got %016X", name, testKeyID(t, keyring), metadata.KeyID)
+			}
+		}
+
+		for otherName, other := range keyrings {
+			if other == keyring {
+				continue
+			}
+			_, err = other.Decrypt(encBuf)
+			if err == nil {
+				t.Errorf("%s: expected an error decrypting with %s key", name, otherName)
+			}
+		}
+	}
+
+	keyring := testKeyring(t, "ssh-key-rsa")
+	encBuf, err := keyring.Encrypt(NewPlainMessage([]byte("test message")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2; n++ {
+		_, err = keyring.Decrypt(encBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keyring.Wipe()
+	_, err = keyring.Decrypt(encBuf)
+	if !errors.Is(err, ErrKeyringWiped) {
+		t.Errorf("expected %q after wipe, got %v", ErrKeyringWiped, err)
+	}
+	_, err = keyring.Encrypt(NewPlainMessage([]byte("test message")))
+	if !errors.Is(err, ErrKeyringWiped) {
+		t.Errorf("expected %q encrypting after wipe, got %v", ErrKeyringWiped, err)
+	}
+}
@@ -0,0 +1,91 @@
+package fuse
+
+import (
+	"time"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+// Listing is what directory listing reveals about directory children,
+// children could be looked up by name regardless of it.
+type Listing = string
+
+const (
+	ListingAll     Listing = "all"
+	ListingNone    Listing = "none"
+	ListingAllowed Listing = "allowed"
+)
+
+// policyNode is implemented by nodes which attributes restrict access by policy.
+type policyNode interface{ policy() Policy }
+
+//
+
+func validateListing(listing Listing) error {
+	switch listing {
+	case "", ListingAll, ListingNone, ListingAllowed:
+		return nil
+	default:
+		return errors.Errorf(
+			"unsupported listing %q, expected one of: %q, %q, %q",
+			listing, ListingAll, ListingNone, ListingAllowed,
+		)
+	}
+}
+
+func (f *File) policy() Policy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.attr.Policy
+}
+
+func (s *Structured) policy() Policy { return s.getAttr().Policy }
+func (t *Template) policy() Policy   { return t.getAttr().Policy }
+func (o *OTP) policy() Policy        { return o.getFile().policy() }
+
+func (d *Dir) policy() Policy {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.attr.Policy
+}
+
+// listing returns listing of the directory, directories without
+// listing attribute inherit it from the parent directory.
+func (d *Dir) listing() Listing {
+	d.mu.Lock()
+	listing := d.attr.Listing
+	d.mu.Unlock()
+	if listing != "" {
+		return listing
+	}
+
+	_, parent := d.Parent()
+	if parent == nil {
+		return d.root.config.Listing
+	}
+	dir, ok := parent.Operations().(dirNode)
+	if !ok {
+		return d.root.config.Listing
+	}
+	return dir.dir().listing()
+}
+
+// listed reports whether the child should be revealed by the directory listing,
+// children outside of their validity window are never listed and with ListingAllowed
+// children which policy denies access to the caller are not listed either.
+func listed(child *Inode, listing Listing, caller *Caller, now time.Time) bool {
+	if node, ok := child.Operations().(validityNode); ok && node.validity(now) != nil {
+		return false
+	}
+	if listing != ListingAllowed {
+		return true
+	}
+	node, ok := child.Operations().(policyNode)
+	if !ok {
+		return true
+	}
+	policy := node.policy()
+	return policy.Check(caller) == nil
+}
@@ -0,0 +1,267 @@
+package fuse
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// sourceNode is implemented by nodes which are backed by a path in the source tree,
+// relocate points the node (and its children) to the new path after rename.
+type sourceNode interface {
+	sourcePath() string
+	relocate(path string)
+}
+
+//
+
+// candidates returns source paths which could be mounted as name
+// in the source directory, in order of precedence.
+func (f *Fuse) candidates(dir string, name string) []string {
+	paths := make([]string, 0, 2*len(f.config.Suffixes)+2)
+	for _, suffix := range f.config.Suffixes {
+		paths = append(paths, filepath.Join(dir, name+suffix))
+	}
+	for _, suffix := range f.config.Suffixes {
+		paths = append(paths, filepath.Join(dir, name+TemplateSuffix+suffix))
+	}
+	return append(
+		paths,
+		filepath.Join(dir, name+TemplateSuffix),
+		filepath.Join(dir, name),
+	)
+}
+
+// names returns sorted names of the source directory entries in the mountpoint,
+// entries which could not be mounted are filtered out on resolve.
+func (f *Fuse) names(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		names = make([]string, 0, len(entries))
+		seen  = make(map[string]bool, len(entries))
+	)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasSuffix(name, AttrSuffix) {
+			continue
+		}
+		if !entry.IsDir() {
+			name = filepath.Base(f.mountName(filepath.Join(dir, name)))
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// loadDir mounts the source directory at path.
+func (f *Fuse) loadDir(ctx context.Context, path string) error {
+	inodePath, err := filepath.Rel(f.source, path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.mkdir(ctx, inodePath)
+
+	return nil
+}
+
+// resolve returns the child of the directory by name, it is loaded from the source tree
+// if it is not in the tree yet, child which source is gone is removed from the tree.
+// Kernel is not notified about removed entries because it could hold directory lock.
+// Current and parent directory names are never resolved against the source tree.
+func (f *Fuse) resolve(ctx context.Context, d *Dir, name string) (*Inode, error) {
+	if name == "." || name == ".." {
+		return nil, nil
+	}
+
+	child := d.GetChild(name)
+	if child != nil {
+		node, ok := child.Operations().(sourceNode)
+		if !ok {
+			return child, nil
+		}
+		_, err := os.Lstat(node.sourcePath())
+		if err == nil {
+			return child, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if file, ok := node.(*File); ok {
+			if otp, ok := d.companion(name, file); ok {
+				d.RmChild(otp)
+			}
+		}
+		d.RmChild(name)
+	}
+
+	if strings.HasSuffix(name, OTPSuffix) {
+		// companion is mounted along with the file containing totp uri
+		_, err := f.resolve(ctx, d, strings.TrimSuffix(name, OTPSuffix))
+		if err != nil {
+			return nil, err
+		}
+		if child = d.GetChild(name); child != nil {
+			return child, nil
+		}
+	}
+
+	dir := d.sourcePath()
+	for _, path := range f.candidates(dir, name) {
+		info, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		bare := path == filepath.Join(dir, name)
+		switch {
+		case info.IsDir():
+			if !bare {
+				continue
+			}
+			err = f.loadDir(ctx, path)
+		case bare && strings.HasSuffix(name, AttrSuffix):
+			// attributes files are never mounted, even if they match passthrough globs
+			continue
+		case info.Mode().IsRegular() && bare && !f.passthrough(path):
+			continue
+		default:
+			err = f.reload(ctx, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if child = d.GetChild(name); child != nil {
+			return child, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// resolvePath returns inode for the path relative to the mountpoint,
+// every component is resolved against the source tree, nil is returned if it does not exist.
+func (f *Fuse) resolvePath(ctx context.Context, inodePath string) (*Inode, error) {
+	inode := &f.Inode
+	for _, component := range strings.Split(inodePath, string(filepath.Separator)) {
+		if len(component) == 0 || component == "." {
+			continue
+		}
+
+		var err error
+		if dir, ok := inode.Operations().(dirNode); ok {
+			inode, err = f.resolve(ctx, dir.dir(), component)
+		} else {
+			inode = inode.GetChild(component)
+		}
+		if err != nil || inode == nil {
+			return nil, err
+		}
+	}
+
+	return inode, nil
+}
+
+//
+
+func (d *Dir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	child, err := d.root.resolve(ctx, d, name)
+	if err != nil {
+		return nil, d.errno("got an error while looking up directory entry", err)
+	}
+	if child == nil {
+		return nil, syscall.ENOENT
+	}
+
+	if node, ok := child.Operations().(fs.NodeGetattrer); ok {
+		var attrOut fuse.AttrOut
+		errno := node.Getattr(ctx, nil, &attrOut)
+		if errno != fs.OK {
+			return nil, errno
+		}
+		out.Attr = attrOut.Attr
+	}
+
+	return child, fs.OK
+}
+
+// Readdir lists the source directory resolving its entries, entries which are not revealed
+// by the directory listing (see listed) could still be looked up by name.
+func (d *Dir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	listing := d.listing()
+	if listing == ListingNone {
+		return fs.NewListDirStream(nil), fs.OK
+	}
+
+	names, err := d.root.names(d.sourcePath())
+	if err != nil {
+		return nil, d.errno("got an error while reading source directory", err)
+	}
+
+	var (
+		caller  *Caller
+		now     = time.Now()
+		entries = make([]fuse.DirEntry, 0, len(names))
+	)
+	if listing == ListingAllowed {
+		caller = NewCaller(ctx)
+	}
+	for _, name := range names {
+		child, err := d.root.resolve(ctx, d, name)
+		if err != nil {
+			d.root.
+				warn(filepath.Join(d.sourcePath(), name), err).
+				Msg("skipping directory entry because of error")
+			continue
+		}
+		if child == nil {
+			continue
+		}
+		if !listed(child, listing, caller, now) {
+			continue
+		}
+
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Mode: child.Mode(),
+			Ino:  child.StableAttr().Ino,
+		})
+
+		if file, ok := child.Operations().(*File); ok {
+			if otp, ok := d.companion(name, file); ok {
+				entries = append(entries, fuse.DirEntry{
+					Name: otp,
+					Mode: fuse.S_IFREG,
+					Ino:  d.GetChild(otp).StableAttr().Ino,
+				})
+			}
+		}
+	}
+
+	return fs.NewListDirStream(entries), fs.OK
+}
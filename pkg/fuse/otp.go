@@ -0,0 +1,308 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+	"git.backbone/corpix/gpgfs/pkg/log"
+)
+
+const (
+	// OTPSuffix is appended to the name of the file containing TOTP URI
+	// to get the name of the companion file with the current one-time code.
+	OTPSuffix = ".otp"
+	// TOTPScheme is a prefix of TOTP URIs recognized in decrypted content.
+	TOTPScheme = "otpauth://totp/"
+)
+
+type (
+	// TOTP is a time-based one-time password generator (RFC 6238).
+	TOTP struct {
+		Secret    []byte
+		Algorithm func() hash.Hash
+		Digits    int
+		Period    time.Duration
+	}
+
+	// OTP is a read-only companion of the file containing TOTP URI,
+	// its content is the one-time code computed on every open.
+	OTP struct {
+		Inode
+
+		mu   sync.Mutex
+		root *Fuse
+		log  log.Logger
+		file *File
+	}
+	OTPNode interface {
+		fs.NodeOpener
+		fs.NodeGetattrer
+	}
+)
+
+var _ = (OTPNode)((*OTP)(nil))
+
+//
+
+// HasTOTP reports whether content contains TOTP URI.
+func HasTOTP(content []byte) bool {
+	return bytes.Contains(content, []byte(TOTPScheme))
+}
+
+// ParseTOTP finds the first TOTP URI in content and parses it,
+// secret of the returned TOTP should be wiped by the caller.
+// Only the uri is copied out of content, so content could be wiped right after that.
+func ParseTOTP(content []byte) (*TOTP, error) {
+	n := bytes.Index(content, []byte(TOTPScheme))
+	if n < 0 {
+		return nil, errors.New("content has no totp uri")
+	}
+	uri := content[n:]
+	if end := bytes.IndexAny(uri, " \t\r\n\"'"); end >= 0 {
+		uri = uri[:end]
+	}
+
+	u, err := url.Parse(string(uri))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse totp uri")
+	}
+	query := u.Query()
+
+	t := &TOTP{
+		Algorithm: sha1.New,
+		Digits:    6,
+		Period:    30 * time.Second,
+	}
+
+	switch strings.ToUpper(query.Get("algorithm")) {
+	case "", "SHA1":
+	case "SHA256":
+		t.Algorithm = sha256.New
+	case "SHA512":
+		t.Algorithm = sha512.New
+	default:
+		return nil, errors.Errorf("unsupported totp algorithm %q", query.Get("algorithm"))
+	}
+	if digits := query.Get("digits"); digits != "" {
+		t.Digits, err = strconv.Atoi(digits)
+		if err != nil || t.Digits < 6 || t.Digits > 10 {
+			return nil, errors.Errorf("totp digits should be a number from 6 to 10, got %q", digits)
+		}
+	}
+	if period := query.Get("period"); period != "" {
+		seconds, err := strconv.Atoi(period)
+		if err != nil || seconds <= 0 {
+			return nil, errors.Errorf("totp period should be a positive number of seconds, got %q", period)
+		}
+		t.Period = time.Duration(seconds) * time.Second
+	}
+
+	secret := strings.ToUpper(strings.TrimRight(query.Get("secret"), "="))
+	t.Secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode totp secret")
+	}
+	if len(t.Secret) == 0 {
+		return nil, errors.New("totp secret should not be empty")
+	}
+
+	return t, nil
+}
+
+// Code returns the one-time code for the time step containing now.
+func (t *TOTP) Code(now time.Time) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(now.Unix())/uint64(t.Period/time.Second))
+
+	mac := hmac.New(t.Algorithm, t.Secret)
+	_, _ = mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	off := sum[len(sum)-1] & 0x0f
+	code := uint64(binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff)
+
+	mod := uint64(1)
+	for i := 0; i < t.Digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", t.Digits, code%mod)
+}
+
+//
+
+// getFile returns the file containing TOTP URI.
+func (o *OTP) getFile() *File {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.file
+}
+
+// setFile points the companion to the file which replaced the previous one.
+func (o *OTP) setFile(file *File) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.file = file
+}
+
+func (o *OTP) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if writeFlags(flags) {
+		return nil, 0, syscall.EROFS
+	}
+
+	file := o.getFile()
+
+	buf, err := file.secret(ctx, NewCaller(ctx))
+	if err != nil {
+		errno := decryptErrno(err)
+		o.log.
+			Error().
+			Interface("errno", errno).
+			Err(err).
+			Str("path", file.sourcePath()).
+			Msg("got an error while reading totp secret")
+		return nil, 0, errno
+	}
+
+	totp, err := ParseTOTP(buf.Bytes())
+	buf.Destroy()
+	if err != nil {
+		o.log.
+			Error().
+			Err(err).
+			Str("path", file.sourcePath()).
+			Msg("got an error while parsing totp uri")
+		return nil, 0, syscall.EIO
+	}
+	defer WipeBytes(totp.Secret)
+
+	// code changes every period, it should never be served from the page cache
+	return &contentHandle{content: NewEnclave([]byte(totp.Code(time.Now())))}, fuse.FOPEN_DIRECT_IO, fs.OK
+}
+
+func (o *OTP) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	file := o.getFile()
+
+	file.mu.Lock()
+	attr := file.attr
+	file.mu.Unlock()
+
+	out.Attr = *attr.FuseAttr
+	out.Attr.Mode = attr.Mode & 0444
+	out.Attr.Owner = attr.owner(&file.Inode)
+	out.Attr.Nlink = 1
+	setSourceTimes(&out.Attr, file.sourcePath())
+	out.Attr.Size = 0
+	if h, ok := fh.(*contentHandle); ok && h.content != nil {
+		out.Attr.Size = uint64(h.content.Size())
+	}
+
+	return fs.OK
+}
+
+func NewOTP(root *Fuse, file *File) *OTP {
+	return &OTP{
+		root: root,
+		log:  root.log,
+		file: file,
+	}
+}
+
+//
+
+// mountOTP adds or removes the companion of the file inode base in inodeParent
+// depending on whether file content contains TOTP URI, it should be called with f.mu held.
+// Existing companion is pointed to the file, so the kernel is notified only if it is removed.
+func (f *Fuse) mountOTP(ctx context.Context, inodeParent *Inode, base string, file *File, enabled bool) {
+	name := base + OTPSuffix
+
+	inode := inodeParent.GetChild(name)
+	if inode != nil {
+		otp, ok := inode.Operations().(*OTP)
+		if !ok {
+			if enabled {
+				f.
+					warn(file.sourcePath(), nil).
+					Str("name", name).
+					Msg("skipping totp file which is shadowed by another file")
+			}
+			return
+		}
+		if enabled {
+			otp.setFile(file)
+			return
+		}
+		inodeParent.RmChild(name)
+		f.forget(inodeParent, name)
+	}
+	if !enabled {
+		return
+	}
+
+	// companion is persistent because it is mounted along with decrypted
+	// file content and could not be resolved on lookup by itself
+	inode = inodeParent.NewPersistentInode(
+		ctx,
+		NewOTP(f, file),
+		f.stableAttr(fuse.S_IFREG, file.sourcePath()+OTPSuffix),
+	)
+
+	f.log.
+		Info().
+		Str("inode", inode.String()).
+		Str("path", file.sourcePath()).
+		Str("name", name).
+		Msg("mounting totp file")
+	inodeParent.AddChild(name, inode, false)
+}
+
+// mountLazyOTP adds or removes the companion of the lazy file
+// once its content is decrypted, it should be called without f.mu held
+// because file content is decrypted with file mutex held.
+func (f *Fuse) mountLazyOTP(file *File, enabled bool) {
+	f.mu.Lock()
+	base, inodeParent := file.Parent()
+	if inodeParent != nil && inodeParent.GetChild(base) == &file.Inode {
+		f.mountOTP(context.Background(), inodeParent, base, file, enabled)
+	}
+	f.mu.Unlock()
+
+	f.notify()
+}
+
+// unmountOTP removes the companion of the file inode base from inodeParent if it exists,
+// it should be called with f.mu held.
+func (f *Fuse) unmountOTP(inodeParent *Inode, base string) {
+	name := base + OTPSuffix
+
+	inode := inodeParent.GetChild(name)
+	if inode == nil {
+		return
+	}
+	if _, ok := inode.Operations().(*OTP); !ok {
+		return
+	}
+
+	inodeParent.RmChild(name)
+	f.forget(inodeParent, name)
+}
@@ -0,0 +1,129 @@
+package fuse
+
+import (
+	"context"
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B test vectors
+	secrets := map[string]string{
+		"SHA1":   "12345678901234567890",
+		"SHA256": "12345678901234567890123456789012",
+		"SHA512": "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+	samples := []struct {
+		time      int64
+		algorithm string
+		code      string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1111111109, "SHA256", "68084774"},
+		{1111111109, "SHA512", "25091201"},
+		{1111111111, "SHA1", "14050471"},
+		{1111111111, "SHA256", "67062674"},
+		{1111111111, "SHA512", "99943326"},
+		{1234567890, "SHA1", "89005924"},
+		{1234567890, "SHA256", "91819424"},
+		{1234567890, "SHA512", "93441116"},
+		{2000000000, "SHA1", "69279037"},
+		{2000000000, "SHA256", "90698825"},
+		{2000000000, "SHA512", "38618901"},
+		{20000000000, "SHA1", "65353130"},
+		{20000000000, "SHA256", "77737706"},
+		{20000000000, "SHA512", "47863826"},
+	}
+
+	for _, sample := range samples {
+		secret := base32.StdEncoding.EncodeToString([]byte(secrets[sample.algorithm]))
+		uri := TOTPScheme + "test?digits=8&algorithm=" + sample.algorithm + "&secret=" + secret
+
+		totp, err := ParseTOTP([]byte(uri))
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", uri, err)
+		}
+		code := totp.Code(time.Unix(sample.time, 0))
+		if code != sample.code {
+			t.Errorf(
+				"%s code at %d: expected %q, got %q",
+				sample.algorithm, sample.time, sample.code, code,
+			)
+		}
+	}
+}
+
+func TestParseTOTP(t *testing.T) {
+	samples := []struct {
+		content string
+		digits  int
+		period  time.Duration
+		err     bool
+	}{
+		{"hunter2\n" + TOTPScheme + "github?secret=JBSWY3DPEHPK3PXP\n", 6, 30 * time.Second, false},
+		{"url: " + TOTPScheme + "a?secret=jbswy3dpehpk3pxp&period=60 user: bob", 6, 60 * time.Second, false},
+		{TOTPScheme + "a?secret=JBSWY3DPEHPK3PXP&digits=10", 10, 30 * time.Second, false},
+		{"hunter2", 0, 0, true},
+		{TOTPScheme + "a?secret=", 0, 0, true},
+		{TOTPScheme + "a?secret=JBSWY3DPEHPK3PXP&digits=5", 0, 0, true},
+		{TOTPScheme + "a?secret=JBSWY3DPEHPK3PXP&period=0", 0, 0, true},
+		{TOTPScheme + "a?secret=JBSWY3DPEHPK3PXP&algorithm=MD5", 0, 0, true},
+		{TOTPScheme + "a?secret=not-base32", 0, 0, true},
+	}
+
+	for _, sample := range samples {
+		totp, err := ParseTOTP([]byte(sample.content))
+		if sample.err {
+			if err == nil {
+				t.Errorf("expected an error for %q", sample.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", sample.content, err)
+			continue
+		}
+		if totp.Digits != sample.digits || totp.Period != sample.period {
+			t.Errorf(
+				"%q: expected %d digits and %s period, got %d digits and %s period",
+				sample.content, sample.digits, sample.period, totp.Digits, totp.Period,
+			)
+		}
+	}
+}
+
+func TestLazyOTP(t *testing.T) {
+	f := newTestFuse(t, Config{Lazy: true})
+	writeSecret(t, f, "github"+EncryptedSuffix, "hunter2\n"+TOTPScheme+"github?secret=JBSWY3DPEHPK3PXP\n")
+
+	file := resolveNode(t, f, "github").(*File)
+	if f.GetChild("github"+OTPSuffix) != nil {
+		t.Fatal("expected no totp file before lazy file content is decrypted")
+	}
+
+	_, errno := readNode(context.Background(), file)
+	if errno != fs.OK {
+		t.Fatalf("failed to read github: %s", errno)
+	}
+
+	// companion is mounted in background once content is decrypted
+	mounted := eventually(func() bool { return f.GetChild("github"+OTPSuffix) != nil })
+	if !mounted {
+		t.Fatal("expected totp file to be mounted after lazy file content is decrypted")
+	}
+	inode := f.GetChild("github" + OTPSuffix)
+
+	code, errno := readNode(context.Background(), inode.Operations())
+	if errno != fs.OK {
+		t.Fatalf("failed to read github%s: %s", OTPSuffix, errno)
+	}
+	if len(code) != 6 {
+		t.Errorf("expected 6 digit code, got %q", code)
+	}
+}
@@ -0,0 +1,228 @@
+package fuse
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+	"git.backbone/corpix/gpgfs/pkg/log"
+)
+
+// PassthroughConfig selects plaintext files of the source tree
+// which are exposed read-only as they are, files matching any of
+// Exclude globs are hidden even if they match Include globs.
+// Globs are matched against path relative to the source
+// and against the file name.
+type PassthroughConfig struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+func (c *PassthroughConfig) Validate() error {
+	for _, pattern := range append(append([]string{}, c.Include...), c.Exclude...) {
+		_, err := filepath.Match(pattern, "")
+		if err != nil {
+			return errors.Wrapf(err, "invalid passthrough glob %q", pattern)
+		}
+	}
+	return nil
+}
+
+// Match reports whether file at path relative to the source is exposed.
+func (c *PassthroughConfig) Match(path string) bool {
+	return matchGlobs(c.Include, path) && !matchGlobs(c.Exclude, path)
+}
+
+func matchGlobs(patterns []string, path string) bool {
+	base := filepath.Base(path)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//
+
+type (
+	// PlainFile is a read-only plaintext file of the source tree,
+	// content is read from the source on every access.
+	PlainFile struct {
+		Inode
+
+		mu   sync.Mutex
+		root *Fuse
+		log  log.Logger
+		path string
+	}
+	PlainFileNode interface {
+		fs.NodeOpener
+		fs.NodeReader
+		fs.NodeGetattrer
+		fs.NodeGetxattrer
+		fs.NodeListxattrer
+	}
+)
+
+var _ = (PlainFileNode)((*PlainFile)(nil))
+
+//
+
+func (p *PlainFile) sourcePath() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.path
+}
+
+func (p *PlainFile) relocate(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.path = path
+}
+
+func (p *PlainFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if writeFlags(flags) {
+		return nil, 0, syscall.EROFS
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE, fs.OK
+}
+
+func (p *PlainFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (ReadResult, syscall.Errno) {
+	file, err := os.Open(p.sourcePath())
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	defer file.Close()
+
+	n, err := file.ReadAt(dest, off)
+	if err != nil && n == 0 && !errors.Is(err, io.EOF) {
+		return nil, fs.ToErrno(err)
+	}
+
+	return fuse.ReadResultData(dest[:n]), fs.OK
+}
+
+func (p *PlainFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	info, err := os.Stat(p.sourcePath())
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+
+	out.Mode = fuse.S_IFREG | uint32(info.Mode().Perm()&0444)
+	out.Size = uint64(info.Size())
+	out.Nlink = 1
+	setTimes(&out.Attr, info)
+
+	return fs.OK
+}
+
+// xattrs returns extended attributes of the plaintext file,
+// it is marked so it could not be mistaken for decrypted content.
+func (p *PlainFile) xattrs() map[string]string {
+	return map[string]string{
+		XattrSource:    p.sourcePath(),
+		XattrPlaintext: "true",
+	}
+}
+
+func (p *PlainFile) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	return getxattr(p.xattrs(), attr, dest)
+}
+
+func (p *PlainFile) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	return listxattr(p.xattrs(), dest)
+}
+
+func NewPlainFile(root *Fuse, path string) *PlainFile {
+	return &PlainFile{
+		root: root,
+		log:  root.log,
+		path: path,
+	}
+}
+
+//
+
+// loadPlain mounts the plaintext file at path in the source tree,
+// decrypted file with the same name takes precedence.
+func (f *Fuse) loadPlain(ctx context.Context, path string) error {
+	inodePath, err := f.inodePath(path)
+	if err != nil {
+		f.
+			warn(path, err).
+			Msg("skipping file because of error")
+		return nil
+	}
+
+	err = f.verifyPlain(path)
+	if err != nil {
+		return f.skip(path, err)
+	}
+
+	//
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir, base := filepath.Split(inodePath)
+	inodeParent := f.mkdir(ctx, dir)
+
+	inode := inodeParent.GetChild(base)
+	if inode != nil {
+		switch inode.Operations().(type) {
+		case *PlainFile:
+			f.invalidate(inode)
+
+			f.log.
+				Info().
+				Str("inode", inode.String()).
+				Str("path", path).
+				Msg("reloaded plaintext file")
+			return nil
+		case *File:
+			f.
+				warn(path, nil).
+				Msg("skipping plaintext file which is shadowed by encrypted file")
+			return nil
+		}
+		inodeParent.RmChild(base)
+	}
+
+	inode = inodeParent.NewInode(
+		ctx,
+		NewPlainFile(f, path),
+		f.stableAttr(fuse.S_IFREG, path),
+	)
+
+	f.log.
+		Info().
+		Str("inode", inode.String()).
+		Str("path", path).
+		Str("inode-path", inodePath).
+		Msg("mounting plaintext file")
+	inodeParent.AddChild(base, inode, false)
+
+	return nil
+}
+
+// passthrough reports whether plaintext file at path in the source tree is exposed.
+func (f *Fuse) passthrough(path string) bool {
+	rel, err := filepath.Rel(f.source, path)
+	if err != nil {
+		return false
+	}
+	return f.config.Passthrough.Match(rel)
+}
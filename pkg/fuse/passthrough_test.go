@@ -0,0 +1,88 @@
+package fuse
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPassthroughConfigMatch(t *testing.T) {
+	samples := []struct {
+		name   string
+		config PassthroughConfig
+		path   string
+		match  bool
+	}{
+		{"empty", PassthroughConfig{}, "README.md", false},
+		{"base name", PassthroughConfig{Include: []string{"*.md"}}, "docs/README.md", true},
+		{"relative path", PassthroughConfig{Include: []string{"docs/*.md"}}, "docs/README.md", true},
+		{"relative path mismatch", PassthroughConfig{Include: []string{"docs/*.md"}}, "notes/README.md", false},
+		{"wildcard does not cross directories", PassthroughConfig{Include: []string{"*/README.md"}}, "a/b/README.md", false},
+		{
+			"excluded by base name",
+			PassthroughConfig{Include: []string{"*"}, Exclude: []string{"*.key"}},
+			"ssh/id.key",
+			false,
+		},
+		{
+			"excluded by relative path",
+			PassthroughConfig{Include: []string{"*.md"}, Exclude: []string{"private/*"}},
+			"private/README.md",
+			false,
+		},
+		{
+			"not excluded",
+			PassthroughConfig{Include: []string{"*.md"}, Exclude: []string{"private/*"}},
+			"public/README.md",
+			true,
+		},
+	}
+
+	for _, sample := range samples {
+		match := sample.config.Match(sample.path)
+		if match != sample.match {
+			t.Errorf("%s: expected %t for %q, got %t", sample.name, sample.match, sample.path, match)
+		}
+	}
+}
+
+func TestPlainFileXattr(t *testing.T) {
+	f := newTestFuse(t, Config{Passthrough: &PassthroughConfig{Include: []string{"*.md"}}})
+	path := writeSource(t, f, "README.md", []byte("plaintext"))
+
+	file, ok := resolveNode(t, f, "README.md").(*PlainFile)
+	if !ok {
+		t.Fatal("expected README.md to be a plaintext file")
+	}
+
+	samples := map[string]string{
+		XattrSource:    path,
+		XattrPlaintext: "true",
+	}
+	for name, expected := range samples {
+		dest := make([]byte, 256)
+		n, errno := file.Getxattr(context.Background(), name, dest)
+		if errno != 0 {
+			t.Errorf("%s: expected no error, got %s", name, errno)
+			continue
+		}
+		if string(dest[:n]) != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, dest[:n])
+		}
+	}
+}
+
+func TestPlainFileSignatureRequired(t *testing.T) {
+	f := newTestFuse(t, Config{
+		Passthrough: &PassthroughConfig{Include: []string{"*.md"}},
+		Signature:   &SignatureConfig{Policy: SignaturePolicyRequire},
+	})
+	writeSource(t, f, "README.md", []byte("plaintext"))
+
+	inode, err := f.resolvePath(context.Background(), "README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inode != nil {
+		t.Error("expected plaintext file to be hidden with required signature")
+	}
+}
@@ -0,0 +1,95 @@
+package fuse
+
+import (
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+// Policy restricts access to the file by the caller identity,
+// every non-empty list should match the caller, empty policy allows everyone.
+type Policy struct {
+	AllowUids   []uint32 `yaml:"allow-uids"`
+	AllowGroups []string `yaml:"allow-groups"` // group names or numeric gids
+	AllowExe    []string `yaml:"allow-exe"`    // executable path globs
+
+	gids []uint32
+}
+
+func (p *Policy) Expand() error {
+	p.gids = make([]uint32, 0, len(p.AllowGroups))
+	for _, group := range p.AllowGroups {
+		gid := group
+		_, err := strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return err
+			}
+			gid = g.Gid
+		}
+
+		id, err := strconv.ParseUint(gid, 10, 32)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parseint given gid %q", gid)
+		}
+		p.gids = append(p.gids, uint32(id))
+	}
+
+	for _, pattern := range p.AllowExe {
+		_, err := filepath.Match(pattern, "")
+		if err != nil {
+			return errors.Wrapf(err, "invalid executable pattern %q", pattern)
+		}
+	}
+
+	return nil
+}
+
+// Check returns an error describing the reason if caller is not allowed by policy.
+func (p *Policy) Check(c *Caller) error {
+	if len(p.AllowUids) > 0 && !containsUint32(p.AllowUids, c.Uid) {
+		return errors.Errorf("uid %d is not allowed", c.Uid)
+	}
+
+	if len(p.gids) > 0 {
+		allowed := containsUint32(p.gids, c.Gid)
+		for _, gid := range c.Groups {
+			if allowed {
+				break
+			}
+			allowed = containsUint32(p.gids, gid)
+		}
+		if !allowed {
+			return errors.Errorf("gid %d and groups %v are not allowed", c.Gid, c.Groups)
+		}
+	}
+
+	if len(p.AllowExe) > 0 {
+		allowed := false
+		if c.Exe != "" {
+			for _, pattern := range p.AllowExe {
+				allowed, _ = filepath.Match(pattern, c.Exe)
+				if allowed {
+					break
+				}
+			}
+		}
+		if !allowed {
+			return errors.Errorf("executable %q is not allowed", c.Exe)
+		}
+	}
+
+	return nil
+}
+
+func containsUint32(xs []uint32, x uint32) bool {
+	for _, v := range xs {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
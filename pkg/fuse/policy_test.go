@@ -0,0 +1,46 @@
+package fuse
+
+import "testing"
+
+func TestPolicyCheck(t *testing.T) {
+	samples := []struct {
+		name    string
+		policy  Policy
+		caller  Caller
+		allowed bool
+	}{
+		{"empty", Policy{}, Caller{Uid: 1000}, true},
+		{"uid", Policy{AllowUids: []uint32{0, 1000}}, Caller{Uid: 1000}, true},
+		{"uid denied", Policy{AllowUids: []uint32{0}}, Caller{Uid: 1000}, false},
+		{"gid", Policy{AllowGroups: []string{"100"}}, Caller{Gid: 100}, true},
+		{"supplementary group", Policy{AllowGroups: []string{"10"}}, Caller{Gid: 100, Groups: []uint32{1, 10}}, true},
+		{"group denied", Policy{AllowGroups: []string{"10"}}, Caller{Gid: 100, Groups: []uint32{1}}, false},
+		{"exe", Policy{AllowExe: []string{"/usr/bin/cat", "/nix/store/*/bin/psql"}}, Caller{Exe: "/nix/store/abc-psql/bin/psql"}, true},
+		{"exe denied", Policy{AllowExe: []string{"/usr/bin/cat"}}, Caller{Exe: "/usr/bin/less"}, false},
+		{"unknown exe", Policy{AllowExe: []string{"*"}}, Caller{}, false},
+		{
+			"every list should match",
+			Policy{AllowUids: []uint32{1000}, AllowExe: []string{"/usr/bin/cat"}},
+			Caller{Uid: 1000, Exe: "/usr/bin/less"},
+			false,
+		},
+	}
+
+	for _, sample := range samples {
+		err := sample.policy.Expand()
+		if err != nil {
+			t.Fatalf("%s: failed to expand policy: %s", sample.name, err)
+		}
+		err = sample.policy.Check(&sample.caller)
+		if (err == nil) != sample.allowed {
+			t.Errorf("%s: expected allowed %t, got error %v", sample.name, sample.allowed, err)
+		}
+	}
+}
+
+func TestPolicyExpand(t *testing.T) {
+	policy := Policy{AllowExe: []string{"["}}
+	if policy.Expand() == nil {
+		t.Error("expected an error for invalid executable pattern")
+	}
+}
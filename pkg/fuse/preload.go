@@ -0,0 +1,175 @@
+package fuse
+
+import (
+	"context"
+	iofs "io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+	"git.backbone/corpix/gpgfs/pkg/sync"
+)
+
+type (
+	// decrypted is a content of the source file decrypted ahead of mounting.
+	decrypted struct {
+		content  *Enclave
+		metadata *Metadata
+		otp      bool
+		err      error
+	}
+
+	// walkEntry is a source file found by walk with its content
+	// which is nil if it was not decrypted ahead of mounting.
+	walkEntry struct {
+		path      string
+		mode      iofs.FileMode
+		decrypted *decrypted
+	}
+)
+
+//
+
+// decryptContent decrypts the source file at path,
+// decryption error is returned as a part of the result.
+func (f *Fuse) decryptContent(path string) *decrypted {
+	plainMessage, metadata, err := f.decrypt(path)
+	if err != nil {
+		return &decrypted{err: err}
+	}
+
+	return &decrypted{
+		content:  NewEnclave(plainMessage.Data),
+		metadata: metadata,
+		otp:      HasTOTP(plainMessage.Data),
+	}
+}
+
+// decryptAll decrypts encrypted files among entries by f.config.Workers workers,
+// nothing is decrypted in lazy mode because content is decrypted on first access.
+func (f *Fuse) decryptAll(ctx context.Context, entries []walkEntry) {
+	if f.config.Lazy {
+		return
+	}
+
+	var (
+		wg       = sync.NewWaitGroup()
+		mu       = sync.NewMutex()
+		sem      = sync.NewSemaphore(f.config.Workers, f.config.Workers)
+		total    int
+		done     int
+		started  = time.Now()
+		reported = started
+	)
+	for n := range entries {
+		if entries[n].mode.IsRegular() && f.encrypted(entries[n].path) {
+			total++
+		}
+	}
+	if total == 0 {
+		return
+	}
+
+	for n := range entries {
+		entry := &entries[n]
+		if !entry.mode.IsRegular() || !f.encrypted(entry.path) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		sem.Wait()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { _ = sem.Post() }()
+
+			entry.decrypted = f.decryptContent(entry.path)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			done++
+			if time.Since(reported) >= time.Second || done == total {
+				reported = time.Now()
+				f.log.
+					Info().
+					Str("source", f.source).
+					Int("decrypted", done).
+					Int("total", total).
+					Int("workers", f.config.Workers).
+					Dur("elapsed", reported.Sub(started)).
+					Msg("decrypting source tree")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// encrypted reports whether the source file at path is an encrypted file
+// which content is decrypted when it is mounted.
+func (f *Fuse) encrypted(path string) bool {
+	_, ok := f.suffix(path)
+	return ok && !strings.HasSuffix(f.trimSuffix(path), TemplateSuffix)
+}
+
+// walk loads all files from the source directory tree at root, files are decrypted
+// in parallel and mounted in walk order, so the tree does not depend on decryption timing.
+// Loading continues after errors, all of them are returned combined.
+func (f *Fuse) walk(ctx context.Context, root string, fn func(path string) error) error {
+	var entries []walkEntry
+	err := filepath.WalkDir(
+		root,
+		func(path string, d iofs.DirEntry, err error) error {
+			if err != nil {
+				f.
+					warn(path, err).
+					Msg("skipping file because of error")
+				return nil
+			}
+
+			if d.IsDir() {
+				if fn != nil {
+					return fn(path)
+				}
+				return nil
+			}
+			if strings.HasSuffix(path, AttrSuffix) {
+				return nil
+			}
+
+			entries = append(entries, walkEntry{path: path, mode: d.Type()})
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	f.decryptAll(ctx, entries)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	var errs error
+	for _, entry := range entries {
+		err = f.load(ctx, entry.path, entry.mode, entry.decrypted)
+		if err != nil {
+			errs = errors.CombineErrors(errs, errors.Wrapf(err, "failed to load %q", entry.path))
+		}
+	}
+
+	return errs
+}
+
+// Preload decrypts all files from the source tree, in lazy mode
+// the tree is resolved against the source directory on lookup instead.
+func (f *Fuse) Preload(ctx context.Context) error {
+	f.Dir.setAttr(f.loadDirAttr(f.source))
+	if f.config.Lazy {
+		return nil
+	}
+	return f.walk(ctx, f.source, nil)
+}
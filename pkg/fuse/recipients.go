@@ -0,0 +1,88 @@
+package fuse
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+// Recipients is a keyring of public keys files in the source tree
+// are encrypted to in addition to the mount key.
+type Recipients = openpgp.EntityList
+
+// ErrUnknownRecipient is returned when message recipient key could not be resolved,
+// message should not be encrypted without it because recipient would lose access.
+var ErrUnknownRecipient = errors.New("unknown recipient")
+
+//
+
+// ReadRecipients reads recipients keyring with one or more armored public keys.
+func ReadRecipients(path string) (Recipients, error) {
+	return readPublicKeys(path, "recipients")
+}
+
+// MessageRecipients returns ids of the keys binary or armored message
+// is encrypted to, anonymous recipients are reported as zero ids.
+func MessageRecipients(encBuf []byte) ([]uint64, error) {
+	var r io.Reader = bytes.NewReader(encBuf)
+	if IsArmored(encBuf) {
+		block, err := armor.Decode(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to unarmor message")
+		}
+		r = block.Body
+	}
+
+	var (
+		ids     []uint64
+		packets = packet.NewReader(r)
+	)
+loop:
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read message packets")
+		}
+
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			ids = append(ids, p.KeyId)
+		case *packet.SymmetricKeyEncrypted:
+		default:
+			// session keys precede encrypted data
+			break loop
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("message is not encrypted to any public key")
+	}
+
+	return ids, nil
+}
+
+// sourceRecipients returns ids of the keys the source file at path is encrypted to,
+// nil is returned for files which do not exist yet.
+func (f *Fuse) sourceRecipients(path string) ([]uint64, error) {
+	encBuf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	ids, err := MessageRecipients(encBuf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read recipients of %q", path)
+	}
+	return ids, nil
+}
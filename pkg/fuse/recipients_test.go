@@ -0,0 +1,60 @@
+package fuse
+
+import (
+	"sort"
+	"testing"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+// testRecipients returns recipients keyring with the public key of the keyring.
+func testRecipients(t *testing.T, keyring *Keyring) Recipients {
+	t.Helper()
+
+	return Recipients{keyring.public.GetKeys()[0].GetEntity()}
+}
+
+func TestEncryptTo(t *testing.T) {
+	var (
+		keyring = testKeyring(t, "ssh-key-rsa")
+		other   = testOtherKeyring(t)
+		ids     = []uint64{testKeyID(t, keyring), testKeyID(t, other)}
+	)
+
+	encBuf, err := keyring.EncryptTo(NewPlainMessage([]byte("shared")), ids, testRecipients(t, other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := Armor(encBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, buf := range [][]byte{encBuf, armored} {
+		recipients, err := MessageRecipients(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(recipients, func(i, j int) bool { return recipients[i] < recipients[j] })
+		expected := append([]uint64{}, ids...)
+		sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+		if len(recipients) != len(expected) || recipients[0] != expected[0] || recipients[1] != expected[1] {
+			t.Errorf("expected recipients %016X, got %016X", expected, recipients)
+		}
+	}
+
+	for _, k := range []*Keyring{keyring, other} {
+		plainMessage, err := k.Decrypt(encBuf)
+		if err != nil {
+			t.Fatalf("recipient %016X failed to decrypt: %s", testKeyID(t, k), err)
+		}
+		if string(plainMessage.Data) != "shared" {
+			t.Errorf("expected %q, got %q", "shared", plainMessage.Data)
+		}
+	}
+
+	_, err = keyring.EncryptTo(NewPlainMessage([]byte("shared")), ids, nil)
+	if !errors.Is(err, ErrUnknownRecipient) {
+		t.Errorf("expected %q, got %v", ErrUnknownRecipient, err)
+	}
+}
@@ -0,0 +1,154 @@
+package fuse
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+type (
+	// Signers is a keyring of trusted signers public keys.
+	Signers = openpgp.EntityList
+
+	SignaturePolicy = string
+)
+
+const (
+	SignaturePolicyIgnore  SignaturePolicy = "ignore"
+	SignaturePolicyWarn    SignaturePolicy = "warn"
+	SignaturePolicyRequire SignaturePolicy = "require"
+
+	PublicKeyArmorHeader = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+)
+
+var ErrUntrustedSignature = errors.New("untrusted signature")
+
+// SignatureConfig describes what to do with files which are not signed
+// by any of the keys from Keyring (armored public keys),
+// unsigned files are hidden (or inaccessible in lazy mode) with require policy.
+type SignatureConfig struct {
+	Policy  SignaturePolicy `yaml:"policy"`
+	Keyring string          `yaml:"keyring"`
+}
+
+func (c *SignatureConfig) Default() {
+loop:
+	for {
+		switch {
+		case c.Policy == "":
+			c.Policy = SignaturePolicyIgnore
+		default:
+			break loop
+		}
+	}
+}
+
+func (c *SignatureConfig) Validate() error {
+	switch c.Policy {
+	case SignaturePolicyIgnore:
+		return nil
+	case SignaturePolicyWarn, SignaturePolicyRequire:
+		if c.Keyring == "" {
+			return errors.Errorf("signature policy %q requires trusted signers keyring", c.Policy)
+		}
+		return nil
+	default:
+		return errors.Errorf(
+			"unsupported signature policy %q, expected one of: %q, %q, %q",
+			c.Policy,
+			SignaturePolicyIgnore,
+			SignaturePolicyWarn,
+			SignaturePolicyRequire,
+		)
+	}
+}
+
+// ReadSigners reads trusted signers keyring with one or more armored public keys.
+func ReadSigners(path string) (Signers, error) {
+	return readPublicKeys(path, "trusted signers")
+}
+
+// readPublicKeys reads name keyring with one or more armored public keys.
+func readPublicKeys(path string, name string) (openpgp.EntityList, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys openpgp.EntityList
+	for len(buf) > 0 {
+		start := bytes.Index(buf, []byte(PublicKeyArmorHeader))
+		if start < 0 {
+			break
+		}
+		end := bytes.Index(buf[start+1:], []byte(PublicKeyArmorHeader))
+		if end < 0 {
+			end = len(buf)
+		} else {
+			end += start + 1
+		}
+
+		entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(buf[start:end]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s keyring %q", name, path)
+		}
+		keys = append(keys, entities...)
+		buf = buf[end:]
+	}
+	if len(keys) == 0 {
+		return nil, errors.Errorf("%s keyring %q has no public keys", name, path)
+	}
+
+	return keys, nil
+}
+
+// VerifySignature returns an error if message was not signed by a trusted signer.
+func VerifySignature(metadata *Metadata) error {
+	switch {
+	case metadata.SignerKeyID == 0:
+		return errors.Wrap(ErrUntrustedSignature, "message is not signed")
+	case !metadata.Trusted:
+		return errors.Wrapf(ErrUntrustedSignature, "message is signed by unknown key %016X", metadata.SignerKeyID)
+	case metadata.SignatureError != nil:
+		return errors.Wrapf(ErrUntrustedSignature, "message signature is invalid: %s", metadata.SignatureError)
+	}
+	return nil
+}
+
+// verify applies signature policy to the decrypted message metadata,
+// an error means content should not be exposed.
+func (f *Fuse) verify(path string, metadata *Metadata) error {
+	policy := f.config.Signature.Policy
+	if policy != SignaturePolicyWarn && policy != SignaturePolicyRequire {
+		return nil
+	}
+
+	err := VerifySignature(metadata)
+	if err == nil {
+		return nil
+	}
+	if policy == SignaturePolicyWarn {
+		f.
+			warn(path, err).
+			Msg("exposing file without trusted signature")
+		return nil
+	}
+
+	return err
+}
+
+// verifyPlain applies signature policy to the plaintext file at path,
+// plaintext could not be signed, so it is treated as a message without signature.
+func (f *Fuse) verifyPlain(path string) error {
+	return f.verify(path, &Metadata{})
+}
+
+// editable reports whether content of the mounted files could be changed,
+// files are written back unsigned, so they would be hidden right after that
+// if signature policy requires trusted signature.
+func (f *Fuse) editable() bool {
+	return f.config.Signature.Policy != SignaturePolicyRequire
+}
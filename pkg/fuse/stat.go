@@ -0,0 +1,76 @@
+package fuse
+
+import (
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// ino returns a stable inode number derived from the path in the source tree,
+// it never returns numbers reserved by go-fuse.
+func (f *Fuse) ino(path string) uint64 {
+	rel, err := filepath.Rel(f.source, path)
+	if err != nil {
+		rel = path
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(rel))
+
+	ino := h.Sum64() >> 1
+	if ino <= 1 {
+		ino += 2
+	}
+	return ino
+}
+
+// stableAttr returns stable attributes of the inode for the path in the source tree,
+// every inode gets a new generation because go-fuse hands out existing inode
+// with the same stable attributes instead of the replacement.
+func (f *Fuse) stableAttr(mode uint32, path string) FSAttr {
+	return FSAttr{
+		Mode: mode,
+		Ino:  f.ino(path),
+		Gen:  atomic.AddUint64(&f.generation, 1),
+	}
+}
+
+// setTimes fills timestamps of out which are not set by attributes
+// with timestamps of the source file info.
+func setTimes(out *fuse.Attr, info os.FileInfo) {
+	atime, mtime, ctime := fileTimes(info)
+	if out.Atime == 0 && out.Atimensec == 0 {
+		out.SetTimes(&atime, nil, nil)
+	}
+	if out.Mtime == 0 && out.Mtimensec == 0 {
+		out.SetTimes(nil, &mtime, nil)
+	}
+	if out.Ctime == 0 && out.Ctimensec == 0 {
+		out.SetTimes(nil, nil, &ctime)
+	}
+}
+
+// setSourceTimes fills timestamps of out which are not set by attributes
+// with timestamps of the source file at path, it does nothing if file is gone.
+func setSourceTimes(out *fuse.Attr, path string) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	setTimes(out, info)
+}
+
+// dirNlink returns a number of links to the directory inode,
+// which is its entry in the parent, "." and ".." of each subdirectory.
+func dirNlink(inode *Inode) uint32 {
+	nlink := uint32(2)
+	for _, child := range inode.Children() {
+		if child.IsDir() {
+			nlink++
+		}
+	}
+	return nlink
+}
@@ -0,0 +1,18 @@
+package fuse
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileTimes returns access, modification and status change times of the file.
+func fileTimes(info os.FileInfo) (time.Time, time.Time, time.Time) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime(), info.ModTime(), info.ModTime()
+	}
+	return time.Unix(st.Atim.Unix()),
+		info.ModTime(),
+		time.Unix(st.Ctim.Unix())
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package fuse
+
+import (
+	"os"
+	"time"
+)
+
+// fileTimes returns access, modification and status change times of the file,
+// modification time is used for all of them on this platform.
+func fileTimes(info os.FileInfo) (time.Time, time.Time, time.Time) {
+	return info.ModTime(), info.ModTime(), info.ModTime()
+}
@@ -0,0 +1,501 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-yaml/yaml"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"git.backbone/corpix/gpgfs/pkg/audit"
+	"git.backbone/corpix/gpgfs/pkg/errors"
+	"git.backbone/corpix/gpgfs/pkg/log"
+)
+
+// PasswordField is a name of the field holding the first line of pass-style secrets.
+const PasswordField = "password"
+
+type (
+	// Structured is a read-only directory holding fields of the secret,
+	// nested maps are mounted as Structured directories referencing
+	// the top level directory which owns source path and attributes.
+	Structured struct {
+		Inode
+
+		mu     sync.Mutex
+		root   *Fuse
+		log    log.Logger
+		path   string
+		attr   Attr
+		secret *Structured
+
+		// fields are leaves of the whole secret, their content is evicted
+		// according to cache attributes and decrypted again on next access,
+		// these are used by the top level directory only
+		fields     []*Field
+		loaded     bool
+		generation uint64
+		accessed   time.Time
+	}
+	StructuredNode interface {
+		fs.NodeGetattrer
+	}
+
+	// Field is a read-only file holding a single field of the structured secret,
+	// key is a path of the field in the secret, content is guarded by secret mutex
+	// and size is kept after eviction.
+	Field struct {
+		Inode
+
+		secret  *Structured
+		key     []string
+		content *Enclave
+		size    int64
+	}
+	FieldNode interface {
+		fs.NodeOpener
+		fs.NodeReader
+		fs.NodeGetattrer
+	}
+
+	// fields is a parsed secret, values are either
+	// field content ([]byte) or nested fields.
+	fields map[string]interface{}
+)
+
+var (
+	_ = (StructuredNode)((*Structured)(nil))
+	_ = (FieldNode)((*Field)(nil))
+)
+
+//
+
+func (s *Structured) sourcePath() string {
+	s.secret.mu.Lock()
+	defer s.secret.mu.Unlock()
+
+	return s.secret.path
+}
+
+func (s *Structured) relocate(path string) {
+	s.secret.mu.Lock()
+	defer s.secret.mu.Unlock()
+
+	s.secret.path = path
+}
+
+func (s *Structured) getAttr() Attr {
+	s.secret.mu.Lock()
+	defer s.secret.mu.Unlock()
+
+	return s.secret.attr
+}
+
+// populate creates inodes for fields and nested directories at key in the secret,
+// inode numbers are derived from fields path prefixed with the source path.
+// Fields are persistent because they are not resolved on lookup,
+// they are released along with the secret when it is replaced.
+// It should be called before the secret is added to the tree.
+func (s *Structured) populate(ctx context.Context, tree fields, prefix string, key []string) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch value := tree[name].(type) {
+		case []byte:
+			field := &Field{
+				secret: s.secret,
+				key:    append(key[:len(key):len(key)], name),
+				size:   int64(len(value)),
+			}
+			// NOTE: enclave wipes field value
+			field.content = NewEnclave(value)
+			s.secret.fields = append(s.secret.fields, field)
+
+			inode := s.NewPersistentInode(
+				ctx,
+				field,
+				s.root.stableAttr(fuse.S_IFREG, filepath.Join(prefix, name)),
+			)
+			s.AddChild(name, inode, false)
+		case fields:
+			dir := &Structured{root: s.root, log: s.log, secret: s.secret}
+			inode := s.NewPersistentInode(
+				ctx,
+				dir,
+				s.root.stableAttr(fuse.S_IFDIR, filepath.Join(prefix, name)),
+			)
+			s.AddChild(name, inode, false)
+			dir.populate(ctx, value, filepath.Join(prefix, name), append(key[:len(key):len(key)], name))
+		}
+	}
+}
+
+// load decrypts the secret again if fields content was evicted,
+// it should be called with secret mutex held.
+func (s *Structured) load() error {
+	s.accessed = time.Now()
+	if s.loaded {
+		return nil
+	}
+
+	plainMessage, _, err := s.root.decrypt(s.path)
+	if err != nil {
+		return err
+	}
+	tree := parseFields(plainMessage.Data)
+	WipeBytes(plainMessage.Data)
+
+	// fields which are gone from the source file stay empty
+	// until the secret is mounted again by the watcher
+	for _, field := range s.fields {
+		value := tree.lookup(field.key)
+		field.size = int64(len(value))
+		field.content = NewEnclave(value)
+	}
+	s.expire()
+
+	s.log.
+		Debug().
+		Str("path", s.path).
+		Msg("decrypted structured secret")
+
+	return nil
+}
+
+// expire schedules eviction of fields content according to cache attributes,
+// it should be called with secret mutex held every time content is loaded.
+func (s *Structured) expire() {
+	s.loaded = true
+	s.generation++
+	s.accessed = time.Now()
+
+	if s.attr.CacheTTL > 0 {
+		s.schedule(s.generation, s.attr.CacheTTL, false)
+	}
+	if s.attr.CacheIdle > 0 {
+		s.schedule(s.generation, s.attr.CacheIdle, true)
+	}
+}
+
+func (s *Structured) schedule(generation uint64, after time.Duration, idle bool) {
+	time.AfterFunc(after, func() {
+		if !s.tryEvict(generation, idle) {
+			return
+		}
+		// fields content also lives in the kernel page cache, see File.schedule
+		for _, field := range s.fields {
+			_ = field.NotifyContent(0, 0)
+		}
+	})
+}
+
+func (s *Structured) tryEvict(generation uint64, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if generation != s.generation {
+		return false
+	}
+	if idle {
+		left := s.attr.CacheIdle - time.Since(s.accessed)
+		if left > 0 {
+			s.schedule(generation, left, idle)
+			return false
+		}
+	}
+
+	for _, field := range s.fields {
+		field.content = nil
+	}
+	s.loaded = false
+	s.generation++
+
+	s.log.
+		Debug().
+		Str("path", s.path).
+		Msg("evicted structured secret content")
+
+	return true
+}
+
+func (s *Structured) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	attr := s.getAttr()
+
+	out.Attr = *attr.FuseAttr
+	// directory should be searchable by those who could read the fields
+	out.Attr.Mode = attr.Mode | (attr.Mode&0444)>>2
+	out.Attr.Owner = attr.owner(&s.secret.Inode)
+	out.Attr.Nlink = dirNlink(&s.Inode)
+	setSourceTimes(&out.Attr, s.sourcePath())
+
+	return fs.OK
+}
+
+func NewStructured(root *Fuse, path string, attr Attr) *Structured {
+	s := &Structured{
+		root: root,
+		log:  root.log,
+		path: path,
+		attr: attr,
+	}
+	s.secret = s
+
+	return s
+}
+
+//
+
+func (f *Field) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if writeFlags(flags) {
+		return nil, 0, syscall.EROFS
+	}
+
+	var (
+		caller = NewCaller(ctx)
+		path   = f.Path(nil)
+		source = f.secret.sourcePath()
+		attr   = f.secret.getAttr()
+	)
+
+	errno := f.secret.root.authorize(attr, path, source, caller, audit.OpOpen, 0, 0)
+	if errno != fs.OK {
+		return nil, 0, errno
+	}
+	if attr.Confirm {
+		errno = f.secret.root.confirm(ctx, path, source, caller)
+		if errno != fs.OK {
+			return nil, 0, errno
+		}
+	}
+
+	return nil, fuse.FOPEN_KEEP_CACHE, fs.OK
+}
+
+func (f *Field) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	attr := f.secret.getAttr()
+	errno := f.secret.root.authorize(
+		attr, f.Path(nil), f.secret.sourcePath(),
+		NewCaller(ctx), audit.OpRead, off, len(dest),
+	)
+	if errno != fs.OK {
+		return nil, errno
+	}
+
+	content, err := f.open()
+	if err != nil {
+		f.secret.log.
+			Error().
+			Err(err).
+			Str("path", f.secret.sourcePath()).
+			Msg("got an error while decrypting structured secret")
+		return nil, decryptErrno(err)
+	}
+	if content == nil {
+		return fuse.ReadResultData(nil), fs.OK
+	}
+
+	buf, err := content.Open()
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+
+	return newDestReadResult(buf, dest, off), fs.OK
+}
+
+func (f *Field) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	attr := f.secret.getAttr()
+
+	out.Attr = *attr.FuseAttr
+	out.Attr.Mode = attr.Mode & 0444
+	out.Attr.Owner = attr.owner(&f.secret.Inode)
+	out.Attr.Nlink = 1
+	setSourceTimes(&out.Attr, f.secret.sourcePath())
+	f.secret.mu.Lock()
+	out.Attr.Size = uint64(f.size)
+	f.secret.mu.Unlock()
+
+	return fs.OK
+}
+
+// open returns the field content enclave decrypting the secret again
+// if it was evicted, empty field has no enclave.
+func (f *Field) open() (*Enclave, error) {
+	f.secret.mu.Lock()
+	defer f.secret.mu.Unlock()
+
+	err := f.secret.load()
+	if err != nil {
+		return nil, err
+	}
+	return f.content, nil
+}
+
+//
+
+// fieldName reports whether name could be used as a file name.
+func fieldName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\x00")
+}
+
+// lookup returns value of the field at key, it is nil if there is no such field.
+func (t fields) lookup(key []string) []byte {
+	for n, name := range key {
+		switch value := t[name].(type) {
+		case []byte:
+			if n == len(key)-1 {
+				return value
+			}
+			return nil
+		case fields:
+			t = value
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// parseFields parses YAML or JSON mapping into fields,
+// anything else is parsed as pass-style secret: first line
+// is a password followed by "key: value" lines.
+func parseFields(data []byte) fields {
+	var document map[string]interface{}
+	err := yaml.Unmarshal(data, &document)
+	if err == nil && len(document) > 0 {
+		return documentFields(document)
+	}
+
+	lines := strings.Split(string(data), "\n")
+	tree := fields{PasswordField: []byte(strings.TrimRight(lines[0], "\r"))}
+	for _, line := range lines[1:] {
+		n := strings.Index(line, ":")
+		if n < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:n])
+		if !fieldName(key) {
+			continue
+		}
+		if _, ok := tree[key]; ok {
+			continue
+		}
+		tree[key] = []byte(strings.TrimSpace(line[n+1:]))
+	}
+
+	return tree
+}
+
+func documentFields(document map[string]interface{}) fields {
+	tree := fields{}
+	for key, value := range document {
+		if !fieldName(key) {
+			continue
+		}
+		tree[key] = documentValue(value)
+	}
+	return tree
+}
+
+func documentValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		document := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			document[fmt.Sprint(key)] = value
+		}
+		return documentFields(document)
+	case nil:
+		return []byte{}
+	case string:
+		return []byte(v)
+	case []interface{}:
+		buf, err := yaml.Marshal(v)
+		if err != nil {
+			return []byte(fmt.Sprint(v))
+		}
+		return bytes.TrimSuffix(buf, []byte("\n"))
+	default:
+		return []byte(fmt.Sprint(v))
+	}
+}
+
+// loadStructured decrypts the source file at path (unless it was decrypted ahead of time as d)
+// and mounts it as a directory of fields, existing inode is replaced
+// because fields could change along with content.
+func (f *Fuse) loadStructured(ctx context.Context, path string, attr Attr, d *decrypted) error {
+	inodePath, err := f.inodePath(path)
+	if err != nil {
+		f.
+			warn(path, err).
+			Msg("skipping file because of error")
+		return nil
+	}
+
+	if d == nil {
+		d = f.decryptContent(path)
+	}
+	if d.err != nil {
+		return f.skip(path, d.err)
+	}
+	tree := parseFields(nil)
+	if d.content != nil {
+		buf, err := d.content.Open()
+		if err != nil {
+			return errors.Wrap(err, "failed to obtain locked buffer from enclave")
+		}
+		tree = parseFields(buf.Bytes())
+		buf.Destroy()
+	}
+
+	//
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir, base := filepath.Split(inodePath)
+	inodeParent := f.mkdir(ctx, dir)
+
+	inode := inodeParent.GetChild(base)
+	if inode != nil {
+		if file, ok := inode.Operations().(*File); ok && file.sourcePath() != path {
+			f.
+				warn(path, nil).
+				Str("shadowed-by", file.sourcePath()).
+				Msg("skipping file which is shadowed by file with another suffix")
+			return nil
+		}
+		inodeParent.RmChild(base)
+		f.forget(inodeParent, base)
+	}
+
+	secret := NewStructured(f, path, attr)
+	inode = inodeParent.NewInode(ctx, secret, f.stableAttr(fuse.S_IFDIR, path))
+	secret.mu.Lock()
+	secret.populate(ctx, tree, path, nil)
+	secret.expire()
+	secret.mu.Unlock()
+
+	f.log.
+		Info().
+		Str("inode", inode.String()).
+		Str("path", path).
+		Str("inode-path", inodePath).
+		Int("fields", len(tree)).
+		Msg("mounting structured secret")
+	inodeParent.AddChild(base, inode, false)
+
+	return nil
+}
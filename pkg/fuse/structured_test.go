@@ -0,0 +1,99 @@
+package fuse
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestParseFields(t *testing.T) {
+	samples := []struct {
+		name   string
+		data   string
+		fields fields
+	}{
+		{
+			name: "pass",
+			data: "hunter2\nuser: bob\nurl: https://github.com\n",
+			fields: fields{
+				PasswordField: []byte("hunter2"),
+				"user":        []byte("bob"),
+				"url":         []byte("https://github.com"),
+			},
+		},
+		{
+			name: "pass with crlf, duplicates and invalid names",
+			data: "hunter2\r\nuser: bob\nuser: alice\n../x: y\nno separator\n",
+			fields: fields{
+				PasswordField: []byte("hunter2"),
+				"user":        []byte("bob"),
+			},
+		},
+		{
+			name:   "empty",
+			data:   "",
+			fields: fields{PasswordField: []byte("")},
+		},
+		{
+			name: "yaml",
+			data: "user: bob\nport: 5432\nempty:\ntags: [a, b]\ndb:\n  host: localhost\n",
+			fields: fields{
+				"user":  []byte("bob"),
+				"port":  []byte("5432"),
+				"empty": []byte{},
+				"tags":  []byte("- a\n- b"),
+				"db":    fields{"host": []byte("localhost")},
+			},
+		},
+		{
+			name: "json",
+			data: `{"user": "bob", "a/b": "skipped", "nested": {"key": true}}`,
+			fields: fields{
+				"user":   []byte("bob"),
+				"nested": fields{"key": []byte("true")},
+			},
+		},
+	}
+
+	for _, sample := range samples {
+		result := parseFields([]byte(sample.data))
+		if !reflect.DeepEqual(result, sample.fields) {
+			t.Errorf("%s: expected %q, got %q", sample.name, sample.fields, result)
+		}
+	}
+}
+
+func TestStructuredEviction(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	writeSecret(t, f, "github"+EncryptedSuffix, "hunter2\nuser: bob\n")
+	writeSource(t, f, "github"+AttrSuffix, []byte("structured: true\ncache-ttl: 50ms\n"))
+
+	secret := resolveNode(t, f, "github").(*Structured)
+	field := resolveNode(t, f, "github/user").(*Field)
+
+	evicted := eventually(func() bool {
+		secret.mu.Lock()
+		defer secret.mu.Unlock()
+		return !secret.loaded && field.content == nil
+	})
+	if !evicted {
+		t.Fatal("expected fields content to be evicted after cache-ttl")
+	}
+
+	var out fuse.AttrOut
+	field.Getattr(context.Background(), nil, &out)
+	if out.Size != uint64(len("bob")) {
+		t.Errorf("expected evicted field to keep size %d, got %d", len("bob"), out.Size)
+	}
+
+	content, errno := readNode(context.Background(), field)
+	if errno != fs.OK {
+		t.Fatalf("failed to read github/user: %s", errno)
+	}
+	if content != "bob" {
+		t.Errorf("expected %q to be decrypted again, got %q", "bob", content)
+	}
+}
@@ -0,0 +1,181 @@
+package fuse
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+	"git.backbone/corpix/gpgfs/pkg/log"
+)
+
+type (
+	Symlink struct {
+		Inode
+
+		mu     sync.Mutex
+		root   *Fuse
+		log    log.Logger
+		path   string
+		target string
+	}
+	SymlinkNode interface {
+		fs.NodeReadlinker
+		fs.NodeGetattrer
+	}
+)
+
+var _ = (SymlinkNode)((*Symlink)(nil))
+
+//
+
+func (s *Symlink) sourcePath() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.path
+}
+
+func (s *Symlink) relocate(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.path = path
+}
+
+func (s *Symlink) setTarget(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.target = target
+}
+
+func (s *Symlink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return []byte(s.target), fs.OK
+}
+
+func (s *Symlink) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out.Mode = fuse.S_IFLNK | 0777
+	out.Size = uint64(len(s.target))
+	out.Nlink = 1
+	setSourceTimes(&out.Attr, s.path)
+
+	return fs.OK
+}
+
+func NewSymlink(root *Fuse, path string, target string) *Symlink {
+	return &Symlink{
+		root:   root,
+		log:    root.log,
+		path:   path,
+		target: target,
+	}
+}
+
+//
+
+// linkTarget reads the symlink at path in the source tree and returns
+// its target remapped to the mounted names relative to the link directory,
+// links which point outside of the source tree are rejected.
+func (f *Fuse) linkTarget(path string) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Dir(path)
+	absTarget := target
+	if !filepath.IsAbs(absTarget) {
+		absTarget = filepath.Join(dir, absTarget)
+	}
+	absTarget = filepath.Clean(absTarget)
+
+	rel, err := filepath.Rel(f.source, absTarget)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf(
+			"symlink target %q points outside of the source %q",
+			target, f.source,
+		)
+	}
+
+	mountTarget, err := filepath.Rel(dir, absTarget)
+	if err != nil {
+		return "", err
+	}
+
+	return f.mountName(mountTarget), nil
+}
+
+// loadSymlink mounts the symlink at path in the source tree,
+// existing symlink inode target is replaced.
+func (f *Fuse) loadSymlink(ctx context.Context, path string) error {
+	target, err := f.linkTarget(path)
+	if err != nil {
+		f.
+			warn(path, err).
+			Msg("skipping symlink because of error")
+		return nil
+	}
+
+	inodePath, err := f.inodePath(path)
+	if err != nil {
+		f.
+			warn(path, err).
+			Msg("skipping symlink because of error")
+		return nil
+	}
+
+	//
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir, base := filepath.Split(inodePath)
+	inodeParent := f.mkdir(ctx, dir)
+
+	inode := inodeParent.GetChild(base)
+	if inode != nil {
+		symlink, ok := inode.Operations().(*Symlink)
+		if ok {
+			symlink.setTarget(target)
+
+			f.log.
+				Info().
+				Str("inode", inode.String()).
+				Str("path", path).
+				Str("target", target).
+				Msg("reloaded symlink")
+			return nil
+		}
+		inodeParent.RmChild(base)
+	}
+
+	inode = inodeParent.NewInode(
+		ctx,
+		NewSymlink(f, path, target),
+		f.stableAttr(fuse.S_IFLNK, path),
+	)
+
+	f.log.
+		Info().
+		Str("inode", inode.String()).
+		Str("path", path).
+		Str("inode-path", inodePath).
+		Str("target", target).
+		Msg("mounting symlink")
+	inodeParent.AddChild(base, inode, false)
+
+	return nil
+}
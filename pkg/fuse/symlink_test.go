@@ -0,0 +1,60 @@
+package fuse
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkTarget(t *testing.T) {
+	root := t.TempDir()
+	source := filepath.Join(root, "source")
+	err := os.MkdirAll(filepath.Join(source, "dir"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &Fuse{
+		source: source,
+		config: Config{Suffixes: []string{EncryptedSuffix}},
+	}
+
+	samples := []struct {
+		link   string
+		target string
+		result string
+		err    bool
+	}{
+		{"sibling", "secret" + EncryptedSuffix, "secret", false},
+		{"template", "config" + TemplateSuffix + EncryptedSuffix, "config", false},
+		{"dir/parent", "../secret" + EncryptedSuffix, "../secret", false},
+		{"dir/absolute", filepath.Join(source, "dir", "key"+EncryptedSuffix), "key", false},
+		{"plain", "notes.txt", "notes.txt", false},
+		{"outside", "../outside" + EncryptedSuffix, "", true},
+		{"dir/outside", "../../outside", "", true},
+		{"absolute", "/etc/passwd", "", true},
+	}
+
+	for _, sample := range samples {
+		path := filepath.Join(source, sample.link)
+		err := os.Symlink(sample.target, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := f.linkTarget(path)
+		if sample.err {
+			if err == nil {
+				t.Errorf("%s: expected an error for target %q", sample.link, sample.target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to resolve target %q: %s", sample.link, sample.target, err)
+			continue
+		}
+		if result != sample.result {
+			t.Errorf("%s: expected %q, got %q", sample.link, sample.result, result)
+		}
+	}
+}
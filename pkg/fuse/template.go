@@ -0,0 +1,343 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"git.backbone/corpix/gpgfs/pkg/audit"
+	"git.backbone/corpix/gpgfs/pkg/errors"
+	"git.backbone/corpix/gpgfs/pkg/log"
+)
+
+// TemplateSuffix marks plaintext or encrypted source files which are
+// mounted as files rendered with text/template, suffix is stripped from the name.
+const TemplateSuffix = ".tmpl"
+
+type (
+	// Template is a read-only file which content is rendered from
+	// the template source on every open, secrets referenced by the
+	// template are accessed on behalf of the caller.
+	Template struct {
+		Inode
+
+		mu   sync.Mutex
+		root *Fuse
+		log  log.Logger
+		path string
+		attr Attr
+	}
+	TemplateNode interface {
+		fs.NodeOpener
+		fs.NodeGetattrer
+	}
+
+	// contentHandle holds content generated on open,
+	// it is served with direct io so it never stays in the page cache.
+	contentHandle struct {
+		content *Enclave
+	}
+)
+
+var (
+	_ = (TemplateNode)((*Template)(nil))
+	_ = (fs.FileReader)((*contentHandle)(nil))
+)
+
+//
+
+func (t *Template) sourcePath() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.path
+}
+
+func (t *Template) relocate(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.path = path
+}
+
+func (t *Template) setAttr(attr Attr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.attr = attr
+}
+
+func (t *Template) getAttr() Attr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.attr
+}
+
+// source returns template source, decrypted if it is encrypted,
+// returned buffer should be wiped by the caller.
+func (t *Template) source() ([]byte, error) {
+	path := t.sourcePath()
+	if _, ok := t.root.suffix(path); !ok {
+		return os.ReadFile(path)
+	}
+
+	plainMessage, _, err := t.root.decrypt(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return plainMessage.Data, nil
+}
+
+func (t *Template) render(ctx context.Context, caller *Caller) (*Enclave, error) {
+	source, err := t.source()
+	if err != nil {
+		return nil, err
+	}
+	defer WipeBytes(source)
+
+	tmpl, err := template.
+		New(filepath.Base(t.sourcePath())).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{
+			"secret": func(path string) (string, error) {
+				buf, err := t.root.secret(ctx, caller, path)
+				if err != nil {
+					return "", err
+				}
+				defer buf.Destroy()
+
+				// template values are strings, rendered content is wiped by the enclave
+				return string(buf.Bytes()), nil
+			},
+			"trim": strings.TrimSpace,
+		}).
+		Parse(string(source))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse template")
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, nil)
+	if err != nil {
+		WipeBytes(buf.Bytes())
+		return nil, errors.Wrap(err, "failed to render template")
+	}
+
+	// NOTE: enclave wipes rendered buffer
+	return NewEnclave(buf.Bytes()), nil
+}
+
+func (t *Template) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if writeFlags(flags) {
+		return nil, 0, syscall.EROFS
+	}
+
+	var (
+		caller = NewCaller(ctx)
+		path   = t.Path(nil)
+		source = t.sourcePath()
+	)
+
+	attr := t.getAttr()
+
+	errno := t.root.authorize(attr, path, source, caller, audit.OpOpen, 0, 0)
+	if errno != fs.OK {
+		return nil, 0, errno
+	}
+	if attr.Confirm {
+		errno = t.root.confirm(ctx, path, source, caller)
+		if errno != fs.OK {
+			return nil, 0, errno
+		}
+	}
+
+	content, err := t.render(ctx, caller)
+	if err != nil {
+		errno := decryptErrno(err)
+		t.log.
+			Error().
+			Interface("errno", errno).
+			Err(err).
+			Str("path", t.sourcePath()).
+			Msg("got an error while rendering template")
+		return nil, 0, errno
+	}
+
+	// rendered content size is not known in advance
+	// and it should not stay in the page cache
+	return &contentHandle{content: content}, fuse.FOPEN_DIRECT_IO, fs.OK
+}
+
+func (t *Template) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	attr := t.getAttr()
+
+	out.Attr = *attr.FuseAttr
+	out.Attr.Owner = attr.owner(&t.Inode)
+	out.Attr.Nlink = 1
+	setSourceTimes(&out.Attr, t.sourcePath())
+	out.Attr.Size = 0
+	if h, ok := fh.(*contentHandle); ok && h.content != nil {
+		out.Attr.Size = uint64(h.content.Size())
+	}
+
+	return fs.OK
+}
+
+func (h *contentHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if h.content == nil {
+		return fuse.ReadResultData(nil), fs.OK
+	}
+
+	buf, err := h.content.Open()
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+
+	return newDestReadResult(buf, dest, off), fs.OK
+}
+
+func NewTemplate(root *Fuse, path string, attr Attr) *Template {
+	return &Template{
+		root: root,
+		log:  root.log,
+		path: path,
+		attr: attr,
+	}
+}
+
+//
+
+// secret returns decrypted content on behalf of the caller in a buffer which should be
+// destroyed by the caller, file policy and approval apply as if the caller has read the file.
+func (f *File) secret(ctx context.Context, caller *Caller) (*LockedBuffer, error) {
+	f.mu.Lock()
+	errno := f.authorize(caller, audit.OpRead, 0, 0)
+	confirm := f.attr.Confirm
+	f.mu.Unlock()
+
+	if errno != fs.OK {
+		return nil, errno
+	}
+	if confirm {
+		errno = f.confirm(ctx, caller)
+		if errno != fs.OK {
+			return nil, errno
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.exhausted() {
+		return nil, ErrBurned
+	}
+
+	buf, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	f.accessed = time.Now()
+	f.reads++
+	defer f.tryBurn()
+
+	return buf, nil
+}
+
+// secret returns decrypted content of the file at path relative to the mountpoint,
+// paths which point outside of the mountpoint are rejected, buffer should be destroyed by the caller.
+func (f *Fuse) secret(ctx context.Context, caller *Caller, path string) (*LockedBuffer, error) {
+	inodePath := filepath.Clean(strings.TrimPrefix(path, string(filepath.Separator)))
+	if inodePath == ".." || strings.HasPrefix(inodePath, ".."+string(filepath.Separator)) {
+		return nil, errors.Errorf("secret %q points outside of the mountpoint", path)
+	}
+
+	inode, err := f.resolvePath(ctx, inodePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up secret %q", path)
+	}
+	if inode == nil {
+		return nil, errors.Errorf("secret %q does not exist", path)
+	}
+	file, ok := inode.Operations().(*File)
+	if !ok {
+		return nil, errors.Errorf("%q is not a secret file", path)
+	}
+
+	return file.secret(ctx, caller)
+}
+
+// templateAttrPath returns a path to the attributes file of the template at path,
+// it is named after the mounted file, so plaintext and encrypted templates share it.
+func (f *Fuse) templateAttrPath(path string) string {
+	return f.mountName(path) + AttrSuffix
+}
+
+// loadTemplate mounts the template at path in the source tree,
+// existing template inode attributes are replaced.
+func (f *Fuse) loadTemplate(ctx context.Context, path string) error {
+	inodePath, err := f.inodePath(path)
+	if err != nil {
+		f.
+			warn(path, err).
+			Msg("skipping template because of error")
+		return nil
+	}
+
+	if _, ok := f.suffix(path); !ok {
+		err = f.verifyPlain(path)
+		if err != nil {
+			return f.skip(path, err)
+		}
+	}
+
+	attr, err := f.loadAttr(f.templateAttrPath(path), f.defaultAttr())
+	if err != nil {
+		return err
+	}
+
+	//
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir, base := filepath.Split(inodePath)
+	inodeParent := f.mkdir(ctx, dir)
+
+	inode := inodeParent.GetChild(base)
+	if inode != nil {
+		if template, ok := inode.Operations().(*Template); ok {
+			// template is rendered on every open, only attributes are reloaded
+			template.setAttr(attr)
+			return nil
+		}
+		inodeParent.RmChild(base)
+	}
+
+	inode = inodeParent.NewInode(
+		ctx,
+		NewTemplate(f, path, attr),
+		f.stableAttr(fuse.S_IFREG, path),
+	)
+
+	f.log.
+		Info().
+		Str("inode", inode.String()).
+		Str("path", path).
+		Str("inode-path", inodePath).
+		Msg("mounting template")
+	inodeParent.AddChild(base, inode, false)
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package fuse
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestTemplateRender(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	writeSecret(t, f, "prod/db"+EncryptedSuffix, "hunter2\n")
+	writeSource(t, f, "database.yml"+TemplateSuffix, []byte(`password: {{ secret "prod/db" | trim }}`))
+
+	content, errno := readNode(context.Background(), resolveNode(t, f, "database.yml"))
+	if errno != fs.OK {
+		t.Fatalf("failed to render template: %s", errno)
+	}
+	if content != "password: hunter2" {
+		t.Errorf("expected %q, got %q", "password: hunter2", content)
+	}
+}
+
+func TestTemplateSecretOutside(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	writeSecret(t, f, "../other/outside"+EncryptedSuffix, "outside")
+	writeSecret(t, f, "dir/inside"+EncryptedSuffix, "inside")
+
+	for _, path := range []string{"../other/outside", "/../other/outside", "dir/../../other/outside", ".."} {
+		_, err := f.secret(context.Background(), &Caller{}, path)
+		if err == nil {
+			t.Errorf("expected an error for secret %q outside of the mountpoint", path)
+		}
+	}
+	if f.GetChild("..") != nil {
+		t.Error("expected no parent directory entry in the root inode")
+	}
+
+	buf, err := f.secret(context.Background(), &Caller{}, "dir/../dir/inside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buf.Destroy()
+	if string(buf.Bytes()) != "inside" {
+		t.Errorf("expected %q, got %q", "inside", buf.Bytes())
+	}
+
+	for _, name := range []string{".", ".."} {
+		inode, err := f.resolve(context.Background(), &f.Dir, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inode != nil {
+			t.Errorf("expected %q not to be resolved", name)
+		}
+	}
+}
+
+func TestTemplateAttr(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	writeSecret(t, f, "prod/db"+EncryptedSuffix, "hunter2")
+	writeSource(t, f, "database.yml"+TemplateSuffix, []byte(`{{ secret "prod/db" }}`))
+	attrPath := writeSource(t, f, "database.yml"+AttrSuffix, []byte("mode: 0440\nallow-uids: [1000]\n"))
+
+	template := resolveNode(t, f, "database.yml").(*Template)
+	var out fuse.AttrOut
+	template.Getattr(context.Background(), nil, &out)
+	if out.Mode != 0o440 {
+		t.Errorf("expected mode from attributes file 0440, got %#o", out.Mode)
+	}
+
+	samples := []struct {
+		name  string
+		attr  string
+		uid   uint32
+		errno syscall.Errno
+	}{
+		{"allowed uid", "allow-uids: [1000]\n", 1000, fs.OK},
+		{"denied uid", "allow-uids: [1000]\n", 1001, syscall.EACCES},
+		{"expired", "valid-before: 2000-01-01T00:00:00Z\n", 1000, syscall.EACCES},
+	}
+	for _, sample := range samples {
+		writeSource(t, f, "database.yml"+AttrSuffix, []byte(sample.attr))
+		err := f.reloadAttr(context.Background(), attrPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, errno := readNode(callerContext(sample.uid), template)
+		if errno != sample.errno {
+			t.Errorf("%s: expected %s, got %s", sample.name, sample.errno, errno)
+		}
+	}
+}
+
+func TestEncryptedTemplateAttr(t *testing.T) {
+	f := newTestFuse(t, Config{})
+	writeSecret(t, f, "database.yml"+TemplateSuffix+EncryptedSuffix, "plaintext")
+	attrPath := writeSource(t, f, "database.yml"+AttrSuffix, []byte("mode: 0440\n"))
+	otherPath := writeSource(t, f, "database.yml"+TemplateSuffix+AttrSuffix, []byte("mode: 0400\n"))
+
+	template := resolveNode(t, f, "database.yml").(*Template)
+	mode := func() uint32 {
+		var out fuse.AttrOut
+		template.Getattr(context.Background(), nil, &out)
+		return out.Mode
+	}
+	if mode() != 0o440 {
+		t.Errorf("expected mode from attributes file named after mounted file 0440, got %#o", mode())
+	}
+
+	err := f.reloadAttr(context.Background(), otherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode() != 0o440 {
+		t.Errorf("expected attributes file named after source file to be ignored, got mode %#o", mode())
+	}
+
+	writeSource(t, f, "database.yml"+AttrSuffix, []byte("mode: 0444\n"))
+	err = f.reloadAttr(context.Background(), attrPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode() != 0o444 {
+		t.Errorf("expected reloaded mode 0444, got %#o", mode())
+	}
+}
+
+func TestTemplateSignatureRequired(t *testing.T) {
+	f := newTestFuse(t, Config{Signature: &SignatureConfig{Policy: SignaturePolicyRequire}})
+	writeSource(t, f, "database.yml"+TemplateSuffix, []byte("plaintext"))
+
+	inode, err := f.resolvePath(context.Background(), "database.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inode != nil {
+		t.Error("expected plaintext template to be hidden with required signature")
+	}
+}
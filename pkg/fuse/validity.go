@@ -0,0 +1,180 @@
+package fuse
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-yaml/yaml"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"git.backbone/corpix/gpgfs/pkg/crypto/container"
+	"git.backbone/corpix/gpgfs/pkg/telemetry/collector"
+)
+
+// Subsystem is a telemetry subsystem of the filesystem metrics.
+const Subsystem = "fuse"
+
+type (
+	// validityNode is implemented by nodes which attributes could limit
+	// the time window they are accessible in.
+	validityNode interface{ validity(now time.Time) error }
+
+	// ExpiringCollector is a telemetry collector which counts mounted secrets
+	// with validity window ending within Config.ExpiringWithin.
+	ExpiringCollector struct {
+		mounts []*Fuse
+		desc   *prometheus.Desc
+	}
+)
+
+//
+
+// validity returns container.ErrInvalid if now is outside
+// of the validity window set by attributes.
+func (a Attr) validity(now time.Time) error {
+	if !a.ValidAfter.IsZero() && !now.After(a.ValidAfter) {
+		return container.ErrInvalid{
+			Relation:  "after",
+			Timestamp: a.ValidAfter,
+			Now:       now,
+		}
+	}
+	if !a.ValidBefore.IsZero() && !now.Before(a.ValidBefore) {
+		return container.ErrInvalid{
+			Relation:  "before",
+			Timestamp: a.ValidBefore,
+			Now:       now,
+		}
+	}
+	return nil
+}
+
+// expiring reports whether the validity window of the secret
+// which is valid now ends within d.
+func (a Attr) expiring(now time.Time, d time.Duration) bool {
+	if a.ValidBefore.IsZero() || a.validity(now) != nil {
+		return false
+	}
+	return a.ValidBefore.Sub(now) <= d
+}
+
+func (f *File) validity(now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.attr.validity(now)
+}
+
+func (s *Structured) validity(now time.Time) error {
+	return s.getAttr().validity(now)
+}
+
+func (t *Template) validity(now time.Time) error {
+	return t.getAttr().validity(now)
+}
+
+func (o *OTP) validity(now time.Time) error {
+	return o.getFile().validity(now)
+}
+
+//
+
+// windows returns attributes holding validity windows of the source tree secrets
+// which end at some point, source tree is walked because not every secret is resolved
+// in the mountpoint, result is cached until a secret or its attributes are loaded
+// or unloaded (see invalidateWindows).
+func (f *Fuse) windows() []Attr {
+	f.windowsMu.Lock()
+	defer f.windowsMu.Unlock()
+
+	if f.windowsLoaded {
+		return f.windowsCache
+	}
+
+	var windows []Attr
+	_ = filepath.WalkDir(
+		f.source,
+		func(path string, d os.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+			if _, encrypted := f.suffix(path); !encrypted {
+				return nil
+			}
+
+			// only validity window is parsed, attributes are not expanded
+			// because it requires user and group lookups
+			attrBuf, err := os.ReadFile(AttrPath(path))
+			if err != nil {
+				return nil
+			}
+			var window struct {
+				ValidAfter  time.Time `yaml:"valid-after"`
+				ValidBefore time.Time `yaml:"valid-before"`
+			}
+			err = yaml.Unmarshal(attrBuf, &window)
+			if err != nil || window.ValidBefore.IsZero() {
+				return nil
+			}
+
+			windows = append(windows, Attr{
+				ValidAfter:  window.ValidAfter,
+				ValidBefore: window.ValidBefore,
+			})
+			return nil
+		},
+	)
+
+	f.windowsCache = windows
+	f.windowsLoaded = true
+
+	return windows
+}
+
+// invalidateWindows drops cached validity windows, they are collected again on next use.
+func (f *Fuse) invalidateWindows() {
+	f.windowsMu.Lock()
+	defer f.windowsMu.Unlock()
+
+	f.windowsCache = nil
+	f.windowsLoaded = false
+}
+
+// expiring returns a number of secrets in the source tree which are about to expire.
+func (f *Fuse) expiring(now time.Time) int {
+	var n int
+	for _, attr := range f.windows() {
+		if attr.expiring(now, f.config.ExpiringWithin) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (c *ExpiringCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *ExpiringCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, f := range c.mounts {
+		ch <- prometheus.MustNewConstMetric(
+			c.desc, prometheus.GaugeValue,
+			float64(f.expiring(now)),
+			f.Target(),
+		)
+	}
+}
+
+func NewExpiringCollector(mounts []*Fuse) *ExpiringCollector {
+	return &ExpiringCollector{
+		mounts: mounts,
+		desc: prometheus.NewDesc(
+			collector.Name(Subsystem, "secrets", "expiring"),
+			"Number of mounted secrets which validity window ends soon",
+			[]string{"target"}, nil,
+		),
+	}
+}
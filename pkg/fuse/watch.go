@@ -0,0 +1,142 @@
+package fuse
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+type (
+	WatchOp    uint8
+	WatchEvent struct {
+		Op   WatchOp
+		Path string
+		Dir  bool
+	}
+)
+
+const (
+	WatchCreate WatchOp = 1 << iota
+	WatchWrite
+	WatchRemove
+)
+
+//
+
+func (f *Fuse) handle(ctx context.Context, w *Watcher, e WatchEvent) error {
+	switch {
+	case e.Op&WatchRemove != 0:
+		if e.Dir {
+			w.Remove(e.Path)
+		}
+		if filepath.Base(e.Path) == DirAttrName {
+			return f.reloadDirAttr(e.Path)
+		}
+		if strings.HasSuffix(e.Path, AttrSuffix) {
+			return f.reloadAttr(ctx, e.Path)
+		}
+		return f.unload(e.Path)
+	case e.Dir:
+		return f.walk(ctx, e.Path, w.Add)
+	case filepath.Base(e.Path) == DirAttrName:
+		return f.reloadDirAttr(e.Path)
+	case strings.HasSuffix(e.Path, AttrSuffix):
+		return f.reloadAttr(ctx, e.Path)
+	default:
+		info, err := os.Lstat(e.Path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// file was replaced or removed before we got to it,
+				// subsequent events will take care of it
+				return nil
+			}
+			return err
+		}
+		_, encrypted := f.suffix(e.Path)
+		switch {
+		case encrypted, info.Mode()&os.ModeSymlink != 0:
+		case strings.HasSuffix(e.Path, TemplateSuffix), f.passthrough(e.Path):
+		default:
+			return nil
+		}
+
+		return f.load(ctx, e.Path, info.Mode(), nil)
+	}
+}
+
+// Watch subscribes to the source tree changes and keeps mounted inodes
+// in sync with it until context is canceled.
+func (f *Fuse) Watch(ctx context.Context) error {
+	w, err := NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "failed to create source tree watcher")
+	}
+
+	err = filepath.WalkDir(
+		f.source,
+		func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				f.
+					warn(path, err).
+					Msg("skipping directory watch because of error")
+				return nil
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			return w.Add(path)
+		},
+	)
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-w.Errors():
+				if !ok {
+					return
+				}
+				f.log.
+					Error().
+					Err(err).
+					Msg("got an error while watching source tree")
+			case e, ok := <-w.Events():
+				if !ok {
+					return
+				}
+
+				f.log.
+					Debug().
+					Str("path", e.Path).
+					Uint8("op", uint8(e.Op)).
+					Bool("dir", e.Dir).
+					Msg("source tree event")
+
+				err := f.handle(ctx, w, e)
+				if err != nil {
+					f.
+						warn(e.Path, err).
+						Msg("failed to apply source tree change")
+				}
+				f.notify()
+			}
+		}
+	}()
+
+	f.log.
+		Info().
+		Str("source", f.source).
+		Msg("watching source tree")
+
+	return nil
+}
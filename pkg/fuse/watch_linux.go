@@ -0,0 +1,150 @@
+package fuse
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+const watchMask = syscall.IN_CREATE |
+	syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_TO |
+	syscall.IN_MOVED_FROM |
+	syscall.IN_DELETE |
+	syscall.IN_ONLYDIR
+
+// Watcher is an inotify(7) based directory watcher,
+// it is not recursive, every directory should be added explicitly.
+type Watcher struct {
+	mu      sync.Mutex
+	file    *os.File
+	watches map[int32]string
+	events  chan WatchEvent
+	errors  chan error
+	done    chan struct{}
+}
+
+func (w *Watcher) Events() <-chan WatchEvent { return w.events }
+func (w *Watcher) Errors() <-chan error      { return w.errors }
+
+func (w *Watcher) Add(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	wd, err := syscall.InotifyAddWatch(int(w.file.Fd()), path, watchMask)
+	if err != nil {
+		return errors.Wrapf(err, "failed to watch %q", path)
+	}
+	w.watches[int32(wd)] = path
+
+	return nil
+}
+
+// Remove drops watches for the path and all directories below it.
+func (w *Watcher) Remove(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	for wd, watchPath := range w.watches {
+		if watchPath == path || strings.HasPrefix(watchPath, prefix) {
+			_, _ = syscall.InotifyRmWatch(int(w.file.Fd()), uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+}
+
+func (w *Watcher) Close() error {
+	close(w.done)
+	return w.file.Close()
+}
+
+func (w *Watcher) read() {
+	defer close(w.events)
+	defer close(w.errors)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				select {
+				case w.errors <- err:
+				case <-w.done:
+				}
+			}
+			return
+		}
+
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(raw.Len)]
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			w.mu.Lock()
+			dir, ok := w.watches[raw.Wd]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.watches, raw.Wd)
+			}
+			w.mu.Unlock()
+			if !ok || len(name) == 0 {
+				continue
+			}
+
+			e := WatchEvent{
+				Path: filepath.Join(dir, strings.TrimRight(string(name), "\x00")),
+				Dir:  raw.Mask&syscall.IN_ISDIR != 0,
+			}
+			switch {
+			case raw.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+				e.Op = WatchRemove
+			case raw.Mask&syscall.IN_MOVED_TO != 0:
+				e.Op = WatchCreate
+			case raw.Mask&syscall.IN_CREATE != 0:
+				if !e.Dir {
+					info, err := os.Lstat(e.Path)
+					if err != nil || info.Mode()&os.ModeSymlink == 0 {
+						// file content is not there yet, wait for IN_CLOSE_WRITE,
+						// symlinks are complete right after creation
+						continue
+					}
+				}
+				e.Op = WatchCreate
+			case raw.Mask&syscall.IN_CLOSE_WRITE != 0:
+				e.Op = WatchWrite
+			default:
+				continue
+			}
+
+			select {
+			case w.events <- e:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+func NewWatcher() (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize inotify")
+	}
+
+	w := &Watcher{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: map[int32]string{},
+		events:  make(chan WatchEvent),
+		errors:  make(chan error),
+		done:    make(chan struct{}),
+	}
+	go w.read()
+
+	return w, nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package fuse
+
+import (
+	"git.backbone/corpix/gpgfs/pkg/errors"
+)
+
+type Watcher struct{}
+
+func (w *Watcher) Events() <-chan WatchEvent { return nil }
+func (w *Watcher) Errors() <-chan error      { return nil }
+func (w *Watcher) Add(path string) error     { return nil }
+func (w *Watcher) Remove(path string)        {}
+func (w *Watcher) Close() error              { return nil }
+
+func NewWatcher() (*Watcher, error) {
+	return nil, errors.New("source tree watching is not supported on this platform")
+}